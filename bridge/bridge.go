@@ -1,13 +1,17 @@
 package bridge
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/42wim/matterbridge-plus/matterclient"
 	"github.com/42wim/matterbridge/matterhook"
 	log "github.com/Sirupsen/logrus"
+	"github.com/mattermost/platform/model"
 	"github.com/peterhellberg/giphy"
 	ircm "github.com/sorcix/irc"
 	"github.com/thoj/go-ircevent"
+	"net"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
@@ -22,7 +26,6 @@ type MMhook struct {
 
 type MMapi struct {
 	mc            *matterclient.MMClient
-	mmMap         map[string]string
 	mmIgnoreNicks []string
 }
 
@@ -30,14 +33,34 @@ type MMirc struct {
 	i              *irc.Connection
 	ircNick        string
 	ircMap         map[string]string
+	ircKeys        map[string]string
+	ircInvites     map[string]time.Time
 	names          map[string][]string
 	ircIgnoreNicks []string
+	ircAccounts    map[string]string
+	ircAway        map[string]string
+	isupport       *ircSupport
+	roster         *ircRoster
+	joinparts      *joinPartAggregator
+	history        *ircHistory
+	ircBatches     map[string]string
+	ircTLS         *tls.Config
+	ircDial        func(address string) (net.Conn, error)
+	caps           *capState
+	ircTags        map[*irc.Event]map[string]string
+	link           *ircLink
 }
 
 type MMMessage struct {
-	Text     string
-	Channel  string
-	Username string
+	Text      string
+	Channel   string
+	ChannelId string
+	Username  string
+	UserId    string
+	Direct    bool
+	Action    bool
+	// model.CHANNEL_*, empty for webhook messages
+	ChannelType string
 }
 
 type Bridge struct {
@@ -45,7 +68,8 @@ type Bridge struct {
 	MMapi
 	MMirc
 	*Config
-	kind string
+	kind    string
+	mmQueue chan func()
 }
 
 type FancyLog struct {
@@ -67,125 +91,304 @@ func NewBridge(name string, config *Config, kind string) *Bridge {
 	b := &Bridge{}
 	b.Config = config
 	b.kind = kind
+	b.mmQueue = make(chan func(), mmQueueSize)
 	b.ircNick = b.Config.IRC.Nick
 	b.ircMap = make(map[string]string)
 	b.MMirc.names = make(map[string][]string)
+	b.ircAccounts = make(map[string]string)
+	b.ircAway = make(map[string]string)
+	b.isupport = newIRCSupport()
+	b.roster = newIRCRoster(b.isupport)
+	b.joinparts = newJoinPartAggregator(b)
+	b.history = newIRCHistory(b.Config.IRC.BacklogStateFile)
+	b.ircBatches = make(map[string]string)
+	b.caps = newCapState()
+	b.ircTags = make(map[*irc.Event]map[string]string)
+	b.link = &ircLink{}
+	b.ircInvites = make(map[string]time.Time)
 	b.ircIgnoreNicks = strings.Fields(b.Config.IRC.IgnoreNicks)
 	b.mmIgnoreNicks = strings.Fields(b.Config.Mattermost.IgnoreNicks)
+	b.buildIRCMap()
 	if kind == Legacy {
-		if len(b.Config.Token) > 0 {
-			for _, val := range b.Config.Token {
-				b.ircMap[val.IRCChannel] = val.MMChannel
-			}
-		}
-
 		b.mh = matterhook.New(b.Config.Mattermost.URL,
 			matterhook.Config{Port: b.Config.Mattermost.Port, Token: b.Config.Mattermost.Token,
 				InsecureSkipVerify: b.Config.Mattermost.SkipTLSVerify,
 				BindAddress:        b.Config.Mattermost.BindAddress})
 	} else {
-		b.mmMap = make(map[string]string)
-		if len(b.Config.Channel) > 0 {
-			for _, val := range b.Config.Channel {
-				b.ircMap[val.IRC] = val.Mattermost
-				b.mmMap[val.Mattermost] = val.IRC
-			}
+		if b.Config.Mattermost.AccessToken != "" {
+			b.mc = matterclient.NewWithToken(b.Config.Mattermost.AccessToken,
+				b.Config.Mattermost.Team, b.Config.Mattermost.Server)
+		} else {
+			b.mc = matterclient.New(b.Config.Mattermost.Login, b.Config.Mattermost.Password,
+				b.Config.Mattermost.Team, b.Config.Mattermost.Server)
 		}
-		b.mc = matterclient.New(b.Config.Mattermost.Login, b.Config.Mattermost.Password,
-			b.Config.Mattermost.Team, b.Config.Mattermost.Server)
 		b.mc.SkipTLSVerify = b.Config.Mattermost.SkipTLSVerify
 		b.mc.NoTLS = b.Config.Mattermost.NoTLS
+		b.mc.LazyLoad = b.Config.Mattermost.LazyLoad
+		b.mc.UserCacheSize = b.Config.Mattermost.UserCacheSize
+		b.mc.OnAuthState(b.handleMMAuthState)
 		flog.mm.Infof("Trying login %s (team: %s) on %s", b.Config.Mattermost.Login, b.Config.Mattermost.Team, b.Config.Mattermost.Server)
 		err := b.mc.Login()
 		if err != nil {
 			flog.mm.Fatal("Can not connect", err)
 		}
 		flog.mm.Info("Login ok")
-		b.mc.JoinChannel(b.Config.Mattermost.Channel)
-		if len(b.Config.Channel) > 0 {
-			for _, val := range b.Config.Channel {
-				b.mc.JoinChannel(val.Mattermost)
-			}
-		}
+		b.setupMMChannels()
 		go b.mc.WsReceiver()
 	}
+	go b.handleMMQueue()
 	flog.irc.Info("Trying IRC connection")
 	b.i = b.createIRC(name)
 	flog.irc.Info("Connection succeeded")
+	// reconnect on errors
+	go b.ircLoop()
 	go b.handleMatter()
 	return b
 }
 
 func (b *Bridge) createIRC(name string) *irc.Connection {
 	i := irc.IRC(b.Config.IRC.Nick, b.Config.IRC.Nick)
-	i.UseTLS = b.Config.IRC.UseTLS
-	i.TLSConfig = &tls.Config{InsecureSkipVerify: b.Config.IRC.SkipTLSVerify}
+	var err error
+	b.ircTLS, err = b.ircTLSConfig()
+	if err != nil {
+		flog.irc.Fatal("Invalid TLS configuration: ", err)
+	}
+	// we connect ourselves, see dialIRC
+	i.Dial = b.dialIRC
+	i.AddCallback("CAP", b.handleCap)
+	b.setupSASL(i)
+	i.AddCallback("*", b.handleTagged)
+	b.ircDial, err = b.ircDialer()
+	if err != nil {
+		flog.irc.Fatal("Invalid connection configuration: ", err)
+	}
+	b.setupCTCP(i)
+	i.AddCallback(ircm.RPL_ISUPPORT, b.handleISupport)
 	if b.Config.IRC.Password != "" {
 		i.Password = b.Config.IRC.Password
 	}
 	i.AddCallback(ircm.RPL_WELCOME, b.handleNewConnection)
-	i.Connect(b.Config.IRC.Server + ":" + strconv.Itoa(b.Config.IRC.Port))
+	// the go-ircevent ERROR callback disconnects, which also removes all
+	// callbacks, we reconnect ourselves (ircLoop)
+	i.ClearCallback("ERROR")
+	i.AddCallback("ERROR", b.handleError)
+	b.registerCallbacks(i)
+	if err := i.Connect(b.Config.IRC.Server + ":" + strconv.Itoa(b.Config.IRC.Port)); err != nil {
+		flog.irc.Fatal("Can not connect: ", err)
+	}
 	return i
 }
 
 func (b *Bridge) handleNewConnection(event *irc.Event) {
-	flog.irc.Info("Registering callbacks")
-	i := b.i
 	b.ircNick = event.Arguments[0]
+	b.ircBatches = make(map[string]string)
+	b.detectBouncer()
+	b.link.setRegistered()
+}
+
+func (b *Bridge) registerCallbacks(i *irc.Connection) {
 	i.AddCallback("PRIVMSG", b.handlePrivMsg)
 	i.AddCallback("CTCP_ACTION", b.handlePrivMsg)
 	i.AddCallback(ircm.RPL_ENDOFNAMES, b.endNames)
 	i.AddCallback(ircm.RPL_NAMREPLY, b.storeNames)
 	i.AddCallback(ircm.RPL_TOPICWHOTIME, b.handleTopicWhoTime)
 	i.AddCallback(ircm.NOTICE, b.handleNotice)
+	i.AddCallback(ircm.INVITE, b.handleInvite)
+	i.AddCallback(ircm.ERR_INVITEONLYCHAN, b.handleInviteOnly)
+	i.AddCallback(ircm.ERR_BADCHANNELKEY, b.handleBadChannelKey)
 	i.AddCallback(ircm.RPL_MYINFO, func(e *irc.Event) { flog.irc.Infof("%s: %s", e.Code, strings.Join(e.Arguments[1:], " ")) })
 	i.AddCallback("PING", func(e *irc.Event) {
-		i.SendRaw("PONG :" + e.Message())
+		b.ircSend("PONG :" + e.Message())
 		flog.irc.Debugf("PING/PONG")
 	})
+	i.AddCallback("JOIN", b.handleAccountJoin)
+	i.AddCallback("ACCOUNT", b.handleAccount)
+	i.AddCallback("AWAY", b.handleAway)
+	i.AddCallback("NICK", b.handleNickQuit)
+	i.AddCallback("QUIT", b.handleNickQuit)
+	i.AddCallback("JOIN", b.handleJoin)
+	i.AddCallback("PART", b.handlePart)
+	i.AddCallback("KICK", b.handleKick)
+	i.AddCallback("QUIT", b.handleQuit)
+	i.AddCallback("NICK", b.handleNick)
+	i.AddCallback("MODE", b.handleMode)
+	i.AddCallback("BATCH", b.handleBatch)
 	if b.Config.Mattermost.ShowJoinPart {
 		i.AddCallback("JOIN", b.handleJoinPart)
 		i.AddCallback("PART", b.handleJoinPart)
 	}
 	i.AddCallback("*", b.handleOther)
+	// join after the MOTD, by then we know the server ISUPPORT parameters
+	i.AddCallback(ircm.RPL_ENDOFMOTD, b.handleEndOfMotd)
+	i.AddCallback(ircm.ERR_NOMOTD, b.handleEndOfMotd)
+}
+
+func (b *Bridge) handleEndOfMotd(event *irc.Event) {
+	if len(b.Config.IRC.Nick) > b.isupport.nicklen {
+		flog.irc.Warnf("Nick %s is longer than the server NICKLEN (%d)", b.Config.IRC.Nick, b.isupport.nicklen)
+	}
 	b.setupChannels()
 }
 
 func (b *Bridge) setupChannels() {
-	i := b.i
+	var channels []string
 	if b.Config.IRC.Channel != "" {
-		flog.irc.Infof("Joining %s as %s", b.Config.IRC.Channel, b.ircNick)
-		i.Join(b.Config.IRC.Channel)
+		channels = append(channels, b.Config.IRC.Channel)
 	}
 	if b.kind == Legacy {
 		for _, val := range b.Config.Token {
-			flog.irc.Infof("Joining %s as %s", val.IRCChannel, b.ircNick)
-			i.Join(val.IRCChannel)
+			channels = append(channels, val.IRCChannel)
+		}
+	} else {
+		for _, val := range b.Config.Channel {
+			channels = append(channels, val.IRC)
+		}
+	}
+	b.joinChannels(channels)
+}
+
+// joinChannels joins channels (with their configured key) using as few JOIN commands as the server allows.
+func (b *Bridge) joinChannels(channels []string) {
+	var batch, keys []string
+	join := func() {
+		if len(batch) == 0 {
+			return
+		}
+		b.ircSend("JOIN " + strings.TrimSpace(strings.Join(batch, ",")+" "+strings.Join(keys, ",")))
+		batch, keys = nil, nil
+	}
+	// keyed channels must be listed before the channels without a key
+	sort.SliceStable(channels, func(i, j int) bool {
+		return b.ircKey(channels[i]) != "" && b.ircKey(channels[j]) == ""
+	})
+	for _, channel := range channels {
+		if !b.isupport.isChannel(channel) {
+			flog.irc.Errorf("Not joining %s: not a valid channel name on this server", channel)
+			continue
+		}
+		flog.irc.Infof("Joining %s as %s", channel, b.ircNick)
+		key := b.ircKey(channel)
+		max := b.isupport.maxTargets("JOIN")
+		length := len(strings.Join(batch, ",")+strings.Join(keys, ",")) + len(channel) + len(key) + 2
+		if len(batch) > 0 && ((max > 0 && len(batch) >= max) || length > b.isupport.lineBudget("JOIN", "", b.ircNick)) {
+			join()
+		}
+		batch = append(batch, channel)
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	join()
+}
+
+// ircKey returns the configured key of channel.
+func (b *Bridge) ircKey(channel string) string {
+	return b.ircKeys[b.isupport.lower(channel)]
+}
+
+// isConfiguredChannel returns true if we're configured to join channel.
+func (b *Bridge) isConfiguredChannel(channel string) bool {
+	_, ok := b.ircMap[b.isupport.lower(channel)]
+	return ok || b.isupport.equal(channel, b.Config.IRC.Channel)
+}
+
+func (b *Bridge) chanServNick() string {
+	if b.Config.IRC.ChanServNick == "" {
+		return "ChanServ"
+	}
+	return b.Config.IRC.ChanServNick
+}
+
+// handleInviteOnly asks ChanServ for an invite when we can't join an invite-only (+i) channel.
+func (b *Bridge) handleInviteOnly(event *irc.Event) {
+	// 473 <nick> <channel> :Cannot join channel (+i)
+	if len(event.Arguments) < 2 {
+		return
+	}
+	channel := event.Arguments[1]
+	if !b.isConfiguredChannel(channel) {
+		return
+	}
+	// don't keep asking if ChanServ doesn't invite us
+	if time.Since(b.ircInvites[b.isupport.lower(channel)]) < time.Minute {
+		flog.irc.Errorf("Can not join %s: %s", channel, event.Message())
+		return
+	}
+	b.ircInvites[b.isupport.lower(channel)] = time.Now()
+	flog.irc.Infof("%s is invite only, asking %s for an invite", channel, b.chanServNick())
+	b.ircPrivmsg(b.chanServNick(), "INVITE "+channel)
+}
+
+// handleInvite joins configured channels we get invited to.
+func (b *Bridge) handleInvite(event *irc.Event) {
+	// INVITE <nick> <channel>
+	if len(event.Arguments) < 2 {
+		return
+	}
+	channel := event.Message()
+	if !b.isConfiguredChannel(channel) {
+		flog.irc.Infof("Ignoring invite from %s to %s", event.Nick, channel)
+		return
+	}
+	flog.irc.Infof("Invited to %s by %s", channel, event.Nick)
+	b.joinChannels([]string{channel})
+}
+
+func (b *Bridge) handleBadChannelKey(event *irc.Event) {
+	// 475 <nick> <channel> :Cannot join channel (+k)
+	if len(event.Arguments) < 2 {
+		return
+	}
+	flog.irc.Errorf("Can not join %s: wrong or missing key", event.Arguments[1])
+}
+
+// buildIRCMap (re)creates the IRC to Mattermost channel map using the server casemapping.
+func (b *Bridge) buildIRCMap() {
+	ircMap := make(map[string]string)
+	ircKeys := make(map[string]string)
+	if b.Config.IRC.ChannelKey != "" {
+		ircKeys[b.isupport.lower(b.Config.IRC.Channel)] = b.Config.IRC.ChannelKey
+	}
+	if b.kind == Legacy {
+		for _, val := range b.Config.Token {
+			ircMap[b.isupport.lower(val.IRCChannel)] = val.MMChannel
+			if val.IRCKey != "" {
+				ircKeys[b.isupport.lower(val.IRCChannel)] = val.IRCKey
+			}
 		}
 	} else {
 		for _, val := range b.Config.Channel {
-			flog.irc.Infof("Joining %s as %s", val.IRC, b.ircNick)
-			i.Join(val.IRC)
+			ircMap[b.isupport.lower(val.IRC)] = val.Mattermost
+			if val.IRCKey != "" {
+				ircKeys[b.isupport.lower(val.IRC)] = val.IRCKey
+			}
 		}
 	}
+	b.ircMap = ircMap
+	b.ircKeys = ircKeys
 }
 
 func (b *Bridge) handleIrcBotCommand(event *irc.Event) bool {
 	parts := strings.Fields(event.Message())
+	if len(parts) == 0 {
+		return false
+	}
 	exp, _ := regexp.Compile("[:,]+$")
 	channel := event.Arguments[0]
 	command := ""
 	if len(parts) == 2 {
 		command = parts[1]
 	}
-	if exp.ReplaceAllString(parts[0], "") == b.ircNick {
+	if b.isupport.equal(exp.ReplaceAllString(parts[0], ""), b.ircNick) {
 		switch command {
 		case "users":
-			usernames := b.mc.UsernamesInChannel(b.getMMChannel(channel))
-			sort.Strings(usernames)
-			b.i.Privmsg(channel, "Users on Mattermost: "+strings.Join(usernames, ", "))
+			b.queueMM(func() {
+				usernames := b.mc.UsernamesInChannel(b.getMMChannel(channel))
+				sort.Strings(usernames)
+				b.ircPrivmsg(channel, "Users on Mattermost: "+strings.Join(usernames, ", "))
+			})
 		default:
-			b.i.Privmsg(channel, "Valid commands are: [users, help]")
+			b.ircPrivmsg(channel, "Valid commands are: [users, help]")
 		}
 		return true
 	}
@@ -193,7 +396,7 @@ func (b *Bridge) handleIrcBotCommand(event *irc.Event) bool {
 }
 
 func (b *Bridge) ircNickFormat(nick string) string {
-	if nick == b.ircNick {
+	if b.isupport.equal(nick, b.ircNick) {
 		return nick
 	}
 	if b.Config.Mattermost.RemoteNickFormat == nil {
@@ -203,28 +406,65 @@ func (b *Bridge) ircNickFormat(nick string) string {
 }
 
 func (b *Bridge) handlePrivMsg(event *irc.Event) {
+	if b.isupport.equal(event.Nick, b.ircNick) {
+		b.handleEcho(event)
+		return
+	}
 	if b.ignoreMessage(event.Nick, event.Message(), "irc") {
 		return
 	}
-	if b.handleIrcBotCommand(event) {
+	if !b.isupport.isChannel(event.Arguments[0]) {
+		b.handleQuery(event)
 		return
 	}
-	msg := ""
+	msg := event.Message()
 	if event.Code == "CTCP_ACTION" {
-		msg = event.Nick + " "
+		msg = formatAction(msg)
+	}
+	if msg == "" {
+		return
+	}
+	if b.handleIrcBotCommand(event) {
+		return
+	}
+	meta := b.ircMeta(event)
+	channel := b.isupport.lower(event.Arguments[0])
+	if b.Config.IRC.Backlog && b.history.seen(channel, meta) {
+		flog.irc.Debugf("Skipping already relayed message on %s from %s", channel, meta.Time)
+		return
 	}
-	msg += event.Message()
-	b.Send(b.ircNickFormat(event.Nick), msg, b.getMMChannel(event.Arguments[0]))
+	if meta.Backlog {
+		msg = "`" + meta.Time.Local().Format("2006-01-02 15:04:05") + "` " + msg
+	}
+	nick, ircChannel := b.ircNickFormat(event.Nick), event.Arguments[0]
+	b.queueMM(func() {
+		err := b.SendMeta(nick, msg, b.getMMChannel(ircChannel), "", meta)
+		// a message that wasn't posted is replayed after the next reconnect
+		if err == nil && b.Config.IRC.Backlog {
+			b.history.update(channel, meta)
+		}
+	})
 }
 
 func (b *Bridge) handleJoinPart(event *irc.Event) {
-	b.Send(b.ircNick, b.ircNickFormat(event.Nick)+" "+strings.ToLower(event.Code)+"s "+event.Message(), b.getMMChannel(event.Arguments[0]))
+	if b.joinPartInterval() > 0 || (event.Code == "JOIN" && b.joinparts.isSplit(event.Arguments[0], event.Nick)) {
+		kind := jpJoin
+		if event.Code == "PART" {
+			kind = jpPart
+		}
+		b.joinparts.add(event.Arguments[0], kind, event.Nick, "")
+		return
+	}
+	// use the channel argument, with extended-join the last argument is the realname
+	b.sendMM(b.ircNickFormat(event.Nick)+" "+strings.ToLower(event.Code)+"s "+event.Arguments[0], event.Arguments[0])
 }
 
 func (b *Bridge) handleNotice(event *irc.Event) {
 	if strings.Contains(event.Message(), "This nickname is registered") {
-		b.i.Privmsg(b.Config.IRC.NickServNick, "IDENTIFY "+b.Config.IRC.NickServPassword)
+		b.ircPrivmsg(b.Config.IRC.NickServNick, "IDENTIFY "+b.Config.IRC.NickServPassword)
+		return
 	}
+	b.relayNotice(event)
 }
 
 func (b *Bridge) nicksPerRow() int {
@@ -252,19 +492,36 @@ func (b *Bridge) storeNames(event *irc.Event) {
 
 func (b *Bridge) endNames(event *irc.Event) {
 	channel := event.Arguments[1]
-	sort.Strings(b.MMirc.names[channel])
+	b.roster.setNames(channel, b.MMirc.names[channel])
+	b.MMirc.names[channel] = nil
+}
+
+// sendNames posts the users on channel to mattermost.
+func (b *Bridge) sendNames(channel string) {
+	if !b.roster.known(channel) {
+		b.Send(b.ircNick, "Not on IRC channel "+channel, b.getMMChannel(channel))
+		return
+	}
+	members := b.roster.members(channel)
+	if b.Config.Mattermost.NickFormatter == "grouped" {
+		b.Send(b.ircNick, groupedformatter(members), b.getMMChannel(channel))
+		return
+	}
+	var nicks []string
+	for _, m := range members {
+		nicks = append(nicks, m.Prefix()+m.Nick)
+	}
 	maxNamesPerPost := (300 / b.nicksPerRow()) * b.nicksPerRow()
 	continued := false
-	for len(b.MMirc.names[channel]) > maxNamesPerPost {
+	for len(nicks) > maxNamesPerPost {
 		b.Send(
 			b.ircNick,
-			b.formatnicks(b.MMirc.names[channel][0:maxNamesPerPost], continued),
+			b.formatnicks(nicks[0:maxNamesPerPost], continued),
 			b.getMMChannel(channel))
-		b.MMirc.names[channel] = b.MMirc.names[channel][maxNamesPerPost:]
+		nicks = nicks[maxNamesPerPost:]
 		continued = true
 	}
-	b.Send(b.ircNick, b.formatnicks(b.MMirc.names[channel], continued), b.getMMChannel(channel))
-	b.MMirc.names[channel] = nil
+	b.Send(b.ircNick, b.formatnicks(nicks, continued), b.getMMChannel(channel))
 }
 
 func (b *Bridge) handleTopicWhoTime(event *irc.Event) {
@@ -281,6 +538,10 @@ func (b *Bridge) handleTopicWhoTime(event *irc.Event) {
 }
 
 func (b *Bridge) handleOther(event *irc.Event) {
+	// logged after parsing the tags (handleTagged)
+	if strings.HasPrefix(event.Raw, "@") {
+		return
+	}
 	flog.irc.Debugf("%#v", event)
 }
 
@@ -289,15 +550,30 @@ func (b *Bridge) Send(nick string, message string, channel string) error {
 }
 
 func (b *Bridge) SendType(nick string, message string, channel string, mtype string) error {
-	if b.Config.Mattermost.PrefixMessagesWithNick {
+	return b.SendMeta(nick, message, channel, mtype, nil)
+}
+
+// SendMeta sends a message to mattermost, meta (if not nil) is added to the post.
+func (b *Bridge) SendMeta(nick string, message string, channel string, mtype string, meta *IRCMeta) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mmPostTimeout)
+	defer cancel()
+	// with the API we show the IRC nick as the poster when the server allows it
+	override := b.kind != Legacy && nick != b.ircNick && !b.Config.Mattermost.PrefixMessagesWithNick &&
+		!b.Config.Mattermost.NoUsernameOverride && b.mc.CanOverrideUsername(ctx)
+	if b.Config.Mattermost.PrefixMessagesWithNick || (b.kind != Legacy && nick != b.ircNick && !override) {
 		if IsMarkup(message) {
 			message = nick + "\n\n" + message
 		} else {
 			message = nick + " " + message
 		}
 	}
+	// the icon is of the IRC nick, not of the formatted one
+	ircNick := nick
+	if meta != nil && meta.Nick != "" {
+		ircNick = meta.Nick
+	}
 	if b.kind == Legacy {
-		matterMessage := matterhook.OMessage{IconURL: b.Config.Mattermost.IconURL}
+		matterMessage := matterhook.OMessage{IconURL: b.iconURL(ircNick)}
 		matterMessage.Channel = channel
 		matterMessage.UserName = nick
 		matterMessage.Type = mtype
@@ -310,10 +586,39 @@ func (b *Bridge) SendType(nick string, message string, channel string, mtype str
 		return nil
 	}
 	flog.mm.Debug("->mattermost channel: ", channel, " ", message)
-	b.mc.PostMessage(channel, message)
+	props := make(map[string]interface{})
+	var createAt int64
+	if meta != nil {
+		props = meta.props()
+		createAt = meta.createAt()
+	}
+	if override {
+		var iconURL string
+		if b.Config.Mattermost.IconURL != "" && b.mc.CanOverrideIcon(ctx) {
+			iconURL = b.iconURL(ircNick)
+		}
+		for k, v := range matterclient.OverrideProps(strings.TrimSpace(nick), iconURL) {
+			props[k] = v
+		}
+	}
+	var err error
+	if len(props) > 0 || createAt != 0 {
+		_, err = b.mc.PostMessagePropsContext(ctx, channel, message, props, createAt)
+	} else {
+		_, err = b.mc.PostMessageContext(ctx, channel, message)
+	}
+	if err != nil {
+		flog.mm.Info(err)
+		return err
+	}
 	return nil
 }
 
+// iconURL returns the IconURL for the posts of nick.
+func (b *Bridge) iconURL(nick string) string {
+	return strings.Replace(b.Config.Mattermost.IconURL, "{NICK}", url.PathEscape(nick), -1)
+}
+
 func (b *Bridge) handleMatterHook(mchan chan *MMMessage) {
 	for {
 		message := b.mh.Receive()
@@ -325,14 +630,36 @@ func (b *Bridge) handleMatterHook(mchan chan *MMMessage) {
 	}
 }
 
+// handleMMAuthState logs changes of our mattermost session, we can't bridge
+// without one so we exit when it can't be renewed.
+func (b *Bridge) handleMMAuthState(state matterclient.AuthState, err error) {
+	switch state {
+	case matterclient.AuthExpired:
+		flog.mm.Warnf("Session expired (%s), logging in again", err)
+	case matterclient.AuthOK:
+		flog.mm.Info("Login ok")
+	case matterclient.AuthFailed:
+		flog.mm.Fatalf("Session no longer valid and can not login again: %s", err)
+	}
+}
+
 func (b *Bridge) handleMatterClient(mchan chan *MMMessage) {
 	for message := range b.mc.MessageChan {
 		// do not post our own messages back to irc
-		if message.Raw.Action == "posted" && b.mc.User.Username != message.Username {
+		if message.Raw.Action == "posted" && b.mc.GetMe().Username != message.Username {
 			m := &MMMessage{}
 			m.Username = message.Username
 			m.Channel = message.Channel
+			m.ChannelId = message.Post.ChannelId
 			m.Text = message.Text
+			m.UserId = message.Post.UserId
+			m.Direct = message.Direct
+			m.ChannelType = message.ChannelType
+			m.Action = message.Post.Type == "me"
+			// attachments are relayed as public links (if enabled on the server)
+			if links := b.mc.GetPublicLinks(message.FileIds); len(links) > 0 {
+				m.Text = strings.TrimSpace(m.Text + "\n" + strings.Join(links, "\n"))
+			}
 			flog.mm.Debugf("<-mattermost channel: %s %#v %#v", message.Channel, message.Post, message.Raw)
 			mchan <- m
 		}
@@ -353,6 +680,14 @@ func (b *Bridge) handleMatter() {
 		if b.ignoreMessage(message.Username, message.Text, "mattermost") {
 			continue
 		}
+		if !b.link.isRegistered() {
+			flog.irc.Errorf("Not connected to IRC, dropping message from %s", message.Username)
+			continue
+		}
+		if message.Direct {
+			b.handleDirectMessage(message)
+			continue
+		}
 		username = message.Username + ": "
 		if b.Config.IRC.RemoteNickFormat != "" {
 			username = strings.Replace(b.Config.IRC.RemoteNickFormat, "{NICK}", message.Username, -1)
@@ -364,21 +699,39 @@ func (b *Bridge) handleMatter() {
 		if len(cmds) == 0 {
 			continue
 		}
+		channel := b.getIRCChannel(message)
+		if channel == "" {
+			flog.mm.Debugf("Dropping message from %s, no IRC channel for %s", message.Username, message.Channel)
+			continue
+		}
 		cmd := cmds[0]
 		switch cmd {
 		case "!users":
 			flog.mm.Info("Received !users from ", message.Username)
-			b.i.SendRaw("NAMES " + b.getIRCChannel(message.Channel))
+			b.sendNames(channel)
 			continue
 		case "!gif":
 			message.Text = b.giphyRandom(strings.Fields(strings.Replace(message.Text, "!gif ", "", 1)))
-			b.Send(b.ircNick, message.Text, b.getIRCChannel(message.Channel))
+			b.Send(b.ircNick, message.Text, channel)
 			continue
 		}
 		texts := strings.Split(message.Text, "\n")
+		budget := b.isupport.lineBudget("PRIVMSG", channel, b.ircNick) - len(username)
+		if message.Action {
+			budget -= ctcpActionOverhead
+		}
 		for _, text := range texts {
 			flog.mm.Debug("Sending message from " + message.Username + " to " + message.Channel)
-			b.i.Privmsg(b.getIRCChannel(message.Channel), username+text)
+			if message.Action {
+				text = stripAction(text)
+			}
+			for _, part := range splitText(text, budget) {
+				if message.Action {
+					b.ircPrivmsg(channel, "\x01ACTION "+username+part+"\x01")
+					continue
+				}
+				b.ircPrivmsg(channel, username+part)
+			}
 		}
 	}
 }
@@ -396,7 +749,7 @@ func (b *Bridge) giphyRandom(query []string) string {
 }
 
 func (b *Bridge) getMMChannel(ircChannel string) string {
-	mmchannel, ok := b.ircMap[ircChannel]
+	mmchannel, ok := b.ircMap[b.isupport.lower(ircChannel)]
 	if !ok {
 		mmchannel = b.Config.Mattermost.Channel
 	}
@@ -406,20 +759,41 @@ func (b *Bridge) getMMChannel(ircChannel string) string {
 	return b.mc.GetChannelId(mmchannel, "")
 }
 
-func (b *Bridge) getIRCChannel(channel string) string {
+func (b *Bridge) getIRCChannel(message *MMMessage) string {
 	if b.kind == Legacy {
 		ircchannel := b.Config.IRC.Channel
-		_, ok := b.Config.Token[channel]
+		_, ok := b.Config.Token[message.Channel]
 		if ok {
-			ircchannel = b.Config.Token[channel].IRCChannel
+			ircchannel = b.Config.Token[message.Channel].IRCChannel
 		}
 		return ircchannel
 	}
-	ircchannel, ok := b.mmMap[channel]
-	if !ok {
-		ircchannel = b.Config.IRC.Channel
+	// resolved now, the channels of the [channel] sections may have been
+	// created or the bot added to them after we started
+	for _, val := range b.Config.Channel {
+		id := b.mc.GetChannelId(val.Mattermost, "")
+		if id == message.ChannelId {
+			return val.IRC
+		}
+		// don't leak the messages of a mapped channel to the default channel
+		if id == "" && mmChannelName(val.Mattermost) == strings.ToLower(message.Channel) {
+			return ""
+		}
+	}
+	// group and direct messages never go to the default channel
+	switch message.ChannelType {
+	case model.CHANNEL_OPEN, model.CHANNEL_PRIVATE:
+		return b.Config.IRC.Channel
+	}
+	return ""
+}
+
+// mmChannelName returns the lowercased channel name of a (team/)name.
+func mmChannelName(channel string) string {
+	if i := strings.Index(channel, "/"); i > 0 {
+		channel = channel[i+1:]
 	}
-	return ircchannel
+	return strings.ToLower(channel)
 }
 
 func (b *Bridge) ignoreMessage(nick string, message string, protocol string) bool {
@@ -429,7 +803,7 @@ func (b *Bridge) ignoreMessage(nick string, message string, protocol string) boo
 	}
 	// should we discard messages ?
 	for _, entry := range ignoreNicks {
-		if nick == entry {
+		if nick == entry || (protocol == "irc" && b.isupport.equal(nick, entry)) {
 			return true
 		}
 	}
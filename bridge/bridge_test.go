@@ -0,0 +1,18 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/thoj/go-ircevent"
+)
+
+func TestHandleIrcBotCommandEmpty(t *testing.T) {
+	b := &Bridge{Config: &Config{}}
+	b.isupport = newIRCSupport()
+	b.ircNick = "bot"
+	for _, msg := range []string{"", " "} {
+		if b.handleIrcBotCommand(&irc.Event{Code: "PRIVMSG", Arguments: []string{"#chan", msg}}) {
+			t.Errorf("%q handled as a command", msg)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package bridge
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// capState is the IRCv3 capability negotiation state of the IRC connection.
+// http://ircv3.net/specs/core/capability-negotiation-3.2.html
+// The vendored go-ircevent doesn't know about capabilities, we start the
+// negotiation when connecting (see dialIRC) and handle the replies here.
+type capState struct {
+	sync.Mutex
+	// capabilities advertised by the server with their value (CAP LS 302)
+	available map[string]string
+	acked     map[string]bool
+	// registration is suspended until we send CAP END
+	negotiating bool
+}
+
+func newCapState() *capState {
+	return &capState{available: make(map[string]string), acked: make(map[string]bool)}
+}
+
+// reset forgets the capabilities of the previous connection.
+func (c *capState) reset(negotiating bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.available = make(map[string]string)
+	c.acked = make(map[string]bool)
+	c.negotiating = negotiating
+}
+
+// has returns true if the server acknowledged capability name.
+func (c *capState) has(name string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.acked[name]
+}
+
+// value returns the value advertised by the server for capability name,
+// e.g. "PLAIN,EXTERNAL" for sasl.
+func (c *capState) value(name string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.available[name]
+	return v, ok
+}
+
+// end returns true if we were still negotiating.
+func (c *capState) end() bool {
+	c.Lock()
+	defer c.Unlock()
+	negotiating := c.negotiating
+	c.negotiating = false
+	return negotiating
+}
+
+// wantedCaps returns the capabilities we request from the server.
+func (b *Bridge) wantedCaps() []string {
+	var caps []string
+	if !b.Config.IRC.DisableIRCv3 {
+		caps = append(caps, ircCaps...)
+		if b.Config.IRC.Backlog {
+			caps = append(caps, backlogCaps...)
+		}
+	}
+	if b.Config.IRC.UseSASL {
+		caps = append(caps, "sasl")
+	}
+	return caps
+}
+
+// endCaps ends the capability negotiation so the server completes our registration.
+func (b *Bridge) endCaps() {
+	if b.caps.end() {
+		b.ircSend("CAP END")
+	}
+}
+
+func (b *Bridge) handleCap(event *irc.Event) {
+	// CAP <nick> <subcommand> [*] :<capabilities>
+	if len(event.Arguments) < 3 {
+		return
+	}
+	caps := strings.Fields(event.Message())
+	c := b.caps
+	switch event.Arguments[1] {
+	case "LS", "NEW":
+		c.Lock()
+		for _, capability := range caps {
+			kv := strings.SplitN(capability, "=", 2)
+			c.available[kv[0]] = ""
+			if len(kv) == 2 {
+				c.available[kv[0]] = kv[1]
+			}
+		}
+		negotiating := c.negotiating
+		c.Unlock()
+		// multiline reply, wait for the last line
+		if event.Arguments[1] == "NEW" || !negotiating || (len(event.Arguments) > 3 && event.Arguments[2] == "*") {
+			return
+		}
+		var req []string
+		for _, capability := range b.wantedCaps() {
+			if _, ok := c.value(capability); ok {
+				req = append(req, capability)
+			}
+		}
+		if len(req) == 0 {
+			b.endCaps()
+			return
+		}
+		b.ircSendf("CAP REQ :%s", strings.Join(req, " "))
+	case "ACK":
+		c.Lock()
+		for _, capability := range caps {
+			c.acked[capability] = true
+		}
+		c.Unlock()
+		flog.irc.Debugf("Enabled capabilities: %s", strings.Join(caps, " "))
+		if b.Config.IRC.UseSASL && c.has("sasl") {
+			b.startSASL()
+			return
+		}
+		b.endCaps()
+	case "NAK":
+		flog.irc.Debugf("Capabilities refused: %s", strings.Join(caps, " "))
+		b.endCaps()
+	case "DEL":
+		c.Lock()
+		for _, capability := range caps {
+			delete(c.acked, capability)
+			delete(c.available, capability)
+		}
+		c.Unlock()
+	}
+}
+
+// unescapeTag unescapes a tag value. Unknown escapes lose the backslash and
+// a trailing backslash is dropped.
+func unescapeTag(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			buf.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			buf.WriteByte(';')
+		case 's':
+			buf.WriteByte(' ')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'n':
+			buf.WriteByte('\n')
+		default:
+			buf.WriteByte(value[i])
+		}
+	}
+	return buf.String()
+}
+
+// parseTags parses IRCv3 message tags (without the leading @).
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = unescapeTag(kv[1])
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+	return tags
+}
+
+// parseIRCLine parses a message without tags like go-ircevent does.
+func parseIRCLine(msg string) (*irc.Event, error) {
+	event := &irc.Event{Raw: msg}
+	if len(msg) < 5 {
+		return nil, errors.New("malformed message from server")
+	}
+	if msg[0] == ':' {
+		i := strings.Index(msg, " ")
+		if i < 0 {
+			return nil, errors.New("malformed message from server")
+		}
+		event.Source = msg[1:i]
+		msg = msg[i+1:]
+		if i, j := strings.Index(event.Source, "!"), strings.Index(event.Source, "@"); i > -1 && j > -1 && i < j {
+			event.Nick = event.Source[0:i]
+			event.User = event.Source[i+1 : j]
+			event.Host = event.Source[j+1:]
+		}
+	}
+	split := strings.SplitN(msg, " :", 2)
+	args := strings.Split(split[0], " ")
+	event.Code = strings.ToUpper(args[0])
+	event.Arguments = args[1:]
+	if len(split) > 1 {
+		event.Arguments = append(event.Arguments, split[1])
+	}
+	return event, nil
+}
+
+// handleTagged runs the callbacks for messages with IRCv3 tags. The vendored
+// go-ircevent doesn't parse tags, it takes them for the command so only the
+// "*" callbacks get these messages.
+func (b *Bridge) handleTagged(event *irc.Event) {
+	if !strings.HasPrefix(event.Raw, "@") {
+		return
+	}
+	i := strings.Index(event.Raw, " ")
+	if i < 0 {
+		return
+	}
+	tagged, err := parseIRCLine(strings.TrimLeft(event.Raw[i+1:], " "))
+	if err != nil {
+		flog.irc.Debugf("%s: %s", err, event.Raw)
+		return
+	}
+	tagged.Connection = event.Connection
+	// callbacks run on the go-ircevent read loop, one message at a time
+	b.ircTags[tagged] = parseTags(event.Raw[1:i])
+	defer delete(b.ircTags, tagged)
+	event.Connection.RunCallbacks(tagged)
+}
+
+// tags returns the IRCv3 tags of event.
+func (b *Bridge) tags(event *irc.Event) map[string]string {
+	return b.ircTags[event]
+}
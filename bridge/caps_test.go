@@ -0,0 +1,64 @@
+package bridge
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thoj/go-ircevent"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want map[string]string
+	}{
+		{"time=2017-01-01T00:00:00.000Z;account=nick", map[string]string{"time": "2017-01-01T00:00:00.000Z", "account": "nick"}},
+		{"a;b=;c=1", map[string]string{"a": "", "b": "", "c": "1"}},
+		{`a=x\:y\sz`, map[string]string{"a": "x;y z"}},
+		{`a=back\\slash`, map[string]string{"a": `back\slash`}},
+		{`a=\r\n`, map[string]string{"a": "\r\n"}},
+		// unknown escapes lose the backslash
+		{`a=\b`, map[string]string{"a": "b"}},
+		// a trailing backslash is dropped
+		{`a=x\`, map[string]string{"a": "x"}},
+		{`a=x\\\`, map[string]string{"a": `x\`}},
+		{`a=\\s`, map[string]string{"a": `\s`}},
+		{"a=1;;b=2", map[string]string{"a": "1", "b": "2"}},
+	}
+	for _, tt := range tests {
+		if got := parseTags(tt.raw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTags(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestHandleTagged(t *testing.T) {
+	b := &Bridge{ircTags: make(map[*irc.Event]map[string]string)}
+	i := irc.IRC("bot", "bot")
+	var got *irc.Event
+	var tags map[string]string
+	i.AddCallback("PRIVMSG", func(event *irc.Event) {
+		got = event
+		tags = b.tags(event)
+	})
+	b.handleTagged(&irc.Event{Raw: `@account=nick;msgid=a\sb :nick!user@host PRIVMSG #chan :hello world`, Connection: i})
+	if got == nil {
+		t.Fatal("PRIVMSG callback not run")
+	}
+	if got.Nick != "nick" || got.Host != "host" || !reflect.DeepEqual(got.Arguments, []string{"#chan", "hello world"}) {
+		t.Errorf("parsed as %+v", got)
+	}
+	if want := map[string]string{"account": "nick", "msgid": "a b"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %q, want %q", tags, want)
+	}
+	if len(b.ircTags) != 0 {
+		t.Errorf("tags kept after the callbacks: %v", b.ircTags)
+	}
+
+	// messages without tags were already handled by go-ircevent
+	got = nil
+	b.handleTagged(&irc.Event{Raw: ":nick!user@host PRIVMSG #chan :hello", Connection: i})
+	if got != nil {
+		t.Error("untagged message handled again")
+	}
+}
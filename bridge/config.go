@@ -8,23 +8,51 @@ import (
 
 type Config struct {
 	IRC struct {
-		UseTLS            bool
-		SkipTLSVerify     bool
-		Server            string
-		Port              int
-		Nick              string
-		Password          string
-		Channel           string
-		UseSlackCircumfix bool
-		NickServNick      string
-		NickServPassword  string
-		RemoteNickFormat  string
-		IgnoreNicks       string
+		UseTLS               bool
+		SkipTLSVerify        bool
+		Server               string
+		Port                 int
+		Nick                 string
+		Password             string
+		Channel              string
+		UseSlackCircumfix    bool
+		NickServNick         string
+		NickServPassword     string
+		RemoteNickFormat     string
+		IgnoreNicks          string
+		ChannelKey           string
+		ChanServNick         string
+		ServiceNicks         string
+		TLSClientCertificate string
+		TLSClientKey         string
+		TLSCACertificate     string
+		TLSServerFingerprint string
+		TLSMinVersion        string
+		UseSASL              bool
+		DisableIRCv3         bool
+		DisableCTCP          bool
+		CTCPVersion          string
+		Proxy                string
+		BindAddress          string
+		IPVersion            string
+		Backlog              bool
+		BacklogStateFile     string
 	}
 	Mattermost struct {
 		URL                    string
 		Port                   int
 		ShowJoinPart           bool
+		JoinPartInterval       int
+		ShowNotice             bool
+		ShowKick               bool
+		ShowMode               bool
+		ShowQuit               bool
+		ShowNick               bool
+		NoticeFormat           string
+		KickFormat             string
+		ModeFormat             string
+		QuitFormat             string
+		NickFormat             string
 		Token                  string
 		IconURL                string
 		SkipTLSVerify          bool
@@ -40,17 +68,28 @@ type Config struct {
 		RemoteNickFormat       *string
 		IgnoreNicks            string
 		NoTLS                  bool
+		AccessToken            string
+		LazyLoad               bool
+		UserCacheSize          int
+		NoUsernameOverride     bool
 	}
 	Token map[string]*struct {
 		IRCChannel string
+		IRCKey     string
 		MMChannel  string
 	}
 	Channel map[string]*struct {
 		IRC        string
+		IRCKey     string
 		Mattermost string
+		Create     bool
+		Private    bool
+		Purpose    string
 	}
 	General struct {
-		GiphyAPIKey string
+		GiphyAPIKey             string
+		PrivateMessages         bool
+		PrivateMessageSeparator string
 	}
 }
 
@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"strings"
+	"time"
+
+	"github.com/thoj/go-ircevent"
+)
+
+const defaultCTCPVersion = "matterbridge-plus"
+
+// ctcpActionOverhead is the length of the "\x01ACTION " and "\x01" around an ACTION.
+const ctcpActionOverhead = len("\x01ACTION \x01")
+
+// ctcpReply sends a CTCP reply (a NOTICE) to nick.
+func (b *Bridge) ctcpReply(nick string, reply string) {
+	b.ircNotice(nick, "\x01"+reply+"\x01")
+}
+
+// setupCTCP replaces the go-ircevent CTCP handlers with our configurable ones.
+func (b *Bridge) setupCTCP(i *irc.Connection) {
+	for _, code := range []string{"CTCP_VERSION", "CTCP_PING", "CTCP_TIME", "CTCP_USERINFO", "CTCP_CLIENTINFO"} {
+		i.ClearCallback(code)
+	}
+	if b.Config.IRC.DisableCTCP {
+		return
+	}
+	version := b.Config.IRC.CTCPVersion
+	if version == "" {
+		version = defaultCTCPVersion
+	}
+	i.AddCallback("CTCP_VERSION", func(e *irc.Event) {
+		b.ctcpReply(e.Nick, "VERSION "+version)
+	})
+	i.AddCallback("CTCP_PING", func(e *irc.Event) {
+		// the message is "PING <token>", echo it back
+		b.ctcpReply(e.Nick, e.Message())
+	})
+	i.AddCallback("CTCP_TIME", func(e *irc.Event) {
+		b.ctcpReply(e.Nick, "TIME "+time.Now().Format(time.RFC1123Z))
+	})
+	i.AddCallback("CTCP_CLIENTINFO", func(e *irc.Event) {
+		b.ctcpReply(e.Nick, "CLIENTINFO ACTION CLIENTINFO PING TIME VERSION")
+	})
+}
+
+// stripAction removes the markdown emphasis Mattermost adds around /me posts.
+func stripAction(text string) string {
+	if len(text) > 2 && (text[0] == '*' || text[0] == '_') && text[len(text)-1] == text[0] {
+		return text[1 : len(text)-1]
+	}
+	return text
+}
+
+// formatAction renders an IRC ACTION as an italic mattermost message, like
+// Mattermost shows /me posts. The nick is added as username or prefix.
+func formatAction(text string) string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+	return "_" + text + "_"
+}
@@ -1,6 +1,7 @@
 package bridge
 
 import (
+	"strconv"
 	"strings"
 )
 
@@ -34,6 +35,42 @@ func plainformatter(nicks []string, nicksPerRow int) string {
 	return strings.Join(nicks, ", ") + " currently on IRC"
 }
 
+// prefixNames are the names used for the groups of groupedformatter.
+var prefixNames = map[string]string{
+	"~": "Owners",
+	"&": "Admins",
+	"@": "Ops",
+	"%": "Halfops",
+	"+": "Voiced",
+	"":  "Users",
+}
+
+func groupedformatter(members []ircMember) string {
+	var lines, nicks []string
+	prefix := ""
+	flush := func() {
+		if len(nicks) == 0 {
+			return
+		}
+		name, ok := prefixNames[prefix]
+		if !ok {
+			name = prefix
+		}
+		lines = append(lines, "**"+name+"**: "+strings.Join(nicks, ", "))
+		nicks = nil
+	}
+	// members are sorted by rank
+	for _, m := range members {
+		if m.Prefix() != prefix {
+			flush()
+			prefix = m.Prefix()
+		}
+		nicks = append(nicks, m.Nick)
+	}
+	flush()
+	return strings.Join(lines, "\n") + "\n\n" + strconv.Itoa(len(members)) + " users currently on IRC"
+}
+
 func IsMarkup(message string) bool {
 	switch message[0] {
 	case '|':
@@ -0,0 +1,184 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thoj/go-ircevent"
+)
+
+const (
+	// messages with a server-time older than this are considered backlog
+	backlogAge = 30 * time.Second
+	// how long to wait before writing the history state file after a change
+	historySaveDelay = 5 * time.Second
+	// CHATHISTORY limit when the server doesn't advertise one
+	defaultHistoryLimit = 100
+)
+
+// bouncer capabilities for message playback
+var backlogCaps = []string{"batch", "draft/chathistory", "chathistory", "znc.in/playback"}
+
+type historyEntry struct {
+	Time  time.Time
+	MsgID string
+}
+
+// ircHistory remembers the last relayed message per channel so we can ask the
+// bouncer (or server) for what we missed after a reconnect or restart.
+type ircHistory struct {
+	sync.Mutex
+	file    string
+	last    map[string]historyEntry
+	pending bool
+	// last relayed message per channel when we (re)joined it, replayed
+	// messages up to this one were already relayed
+	joined map[string]historyEntry
+}
+
+func newIRCHistory(file string) *ircHistory {
+	h := &ircHistory{file: file, last: make(map[string]historyEntry), joined: make(map[string]historyEntry)}
+	if file == "" {
+		return h
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			flog.irc.Errorf("Can not read %s: %s", file, err)
+		}
+		return h
+	}
+	if err := json.Unmarshal(content, &h.last); err != nil {
+		flog.irc.Errorf("Can not parse %s: %s", file, err)
+	}
+	return h
+}
+
+// snapshot records the last relayed message of channel when we join it and
+// returns its time. Live messages after the join don't move this watermark.
+func (h *ircHistory) snapshot(channel string) (time.Time, bool) {
+	h.Lock()
+	defer h.Unlock()
+	e, ok := h.last[channel]
+	if ok {
+		h.joined[channel] = e
+	} else {
+		delete(h.joined, channel)
+	}
+	return e.Time, ok
+}
+
+// seen returns true if the replayed (backlog) message was already relayed
+// before we joined channel.
+func (h *ircHistory) seen(channel string, meta *IRCMeta) bool {
+	if !meta.Backlog || meta.Time.IsZero() {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	e, ok := h.joined[channel]
+	if !ok {
+		return false
+	}
+	return meta.Time.Before(e.Time) || (meta.Time.Equal(e.Time) && meta.MsgID != "" && meta.MsgID == e.MsgID)
+}
+
+// update records the message as relayed.
+func (h *ircHistory) update(channel string, meta *IRCMeta) {
+	if meta.Time.IsZero() {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if e, ok := h.last[channel]; ok && meta.Time.Before(e.Time) {
+		return
+	}
+	h.last[channel] = historyEntry{Time: meta.Time, MsgID: meta.MsgID}
+	if h.file != "" && !h.pending {
+		h.pending = true
+		time.AfterFunc(historySaveDelay, h.save)
+	}
+}
+
+func (h *ircHistory) save() {
+	h.Lock()
+	h.pending = false
+	content, err := json.Marshal(h.last)
+	h.Unlock()
+	if err != nil {
+		flog.irc.Errorf("Can not save history: %s", err)
+		return
+	}
+	tmp := h.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		flog.irc.Errorf("Can not save history: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, h.file); err != nil {
+		flog.irc.Errorf("Can not save history: %s", err)
+	}
+}
+
+// requestHistory asks the bouncer or server for the messages on channel we
+// missed since the last relayed one.
+func (b *Bridge) requestHistory(channel string) {
+	if !b.Config.IRC.Backlog {
+		return
+	}
+	since, ok := b.history.snapshot(b.isupport.lower(channel))
+	if !ok {
+		return
+	}
+	switch {
+	case b.caps.has("draft/chathistory") || b.caps.has("chathistory"):
+		flog.irc.Infof("Requesting history of %s since %s", channel, since)
+		b.ircSendf("CHATHISTORY AFTER %s timestamp=%s %d", channel,
+			since.UTC().Format("2006-01-02T15:04:05.000Z"), b.isupport.historyLimit())
+	case b.caps.has("znc.in/playback"):
+		flog.irc.Infof("Requesting playback of %s since %s", channel, since)
+		ts := strconv.FormatFloat(float64(since.UnixNano())/float64(time.Second), 'f', 3, 64)
+		b.ircPrivmsg("*playback", "PLAY "+channel+" "+ts)
+	}
+}
+
+// handleBatch keeps track of open IRCv3 batches.
+func (b *Bridge) handleBatch(event *irc.Event) {
+	// BATCH +<ref> <type> [params] / BATCH -<ref>
+	if len(event.Arguments) < 1 || len(event.Arguments[0]) < 2 {
+		return
+	}
+	ref := event.Arguments[0]
+	switch ref[0] {
+	case '+':
+		if len(event.Arguments) > 1 {
+			b.ircBatches[ref[1:]] = event.Arguments[1]
+		}
+	case '-':
+		delete(b.ircBatches, ref[1:])
+	}
+}
+
+// isBacklog returns true if the event is a replayed message.
+func (b *Bridge) isBacklog(event *irc.Event, t time.Time) bool {
+	if ref, ok := b.tags(event)["batch"]; ok {
+		switch b.ircBatches[ref] {
+		case "chathistory", "draft/chathistory", "znc.in/playback":
+			return true
+		}
+	}
+	// without a batch we can only guess from the server-time
+	return b.Config.IRC.Backlog && !t.IsZero() && time.Since(t) > backlogAge
+}
+
+// detectBouncer logs the bouncer we're connected to.
+func (b *Bridge) detectBouncer() {
+	if _, ok := b.caps.value("soju.im/bouncer-networks"); ok {
+		flog.irc.Info("Connected to a soju bouncer")
+	} else if _, ok := b.caps.value("znc.in/playback"); ok {
+		flog.irc.Info("Connected to a ZNC bouncer with playback")
+	}
+}
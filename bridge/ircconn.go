@@ -0,0 +1,170 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thoj/go-ircevent"
+)
+
+const (
+	ircDialTimeout = time.Minute
+	// wait this long before trying again when connecting to the IRC server fails
+	ircReconnectDelay = time.Minute
+	// maximum time to write a message to the IRC server
+	ircWriteTimeout = time.Minute
+)
+
+var errIRCDisconnected = errors.New("not connected to IRC")
+
+// ircLink is the connection to the IRC server made by dialIRC. The bridge
+// writes to it directly: go-ircevent queues messages for its write loop,
+// which stops reading the queue when the connection fails, so its send
+// methods block once the queue is full.
+type ircLink struct {
+	sync.Mutex
+	conn net.Conn
+	// we're registered (RPL_WELCOME) on conn
+	registered bool
+}
+
+func (l *ircLink) set(conn net.Conn) {
+	l.Lock()
+	defer l.Unlock()
+	l.conn = conn
+	l.registered = false
+}
+
+func (l *ircLink) setRegistered() {
+	l.Lock()
+	defer l.Unlock()
+	l.registered = l.conn != nil
+}
+
+func (l *ircLink) isRegistered() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.registered
+}
+
+// close closes the connection, go-ircevent's read loop stops with an error.
+func (l *ircLink) close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+	l.registered = false
+}
+
+// write sends line to the server. A connection we can't write to is closed,
+// ircLoop reconnects.
+func (l *ircLink) write(line string) error {
+	l.Lock()
+	conn := l.conn
+	l.Unlock()
+	if conn == nil {
+		return errIRCDisconnected
+	}
+	// writes of one line don't interleave with go-ircevent's writes, it also
+	// sets the deadline before writing
+	conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	if _, err := io.WriteString(conn, line+"\r\n"); err != nil {
+		l.Lock()
+		if l.conn == conn {
+			l.conn = nil
+			l.registered = false
+		}
+		l.Unlock()
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// ircSend sends a raw line to the IRC server, it's dropped while we're disconnected.
+func (b *Bridge) ircSend(line string) {
+	if err := b.link.write(line); err != nil {
+		flog.irc.Errorf("Dropping %s: %s", strings.SplitN(line, " ", 2)[0], err)
+	}
+}
+
+func (b *Bridge) ircSendf(format string, a ...interface{}) {
+	b.ircSend(fmt.Sprintf(format, a...))
+}
+
+func (b *Bridge) ircPrivmsg(target string, message string) {
+	b.ircSend("PRIVMSG " + target + " :" + message)
+}
+
+func (b *Bridge) ircNotice(target string, message string) {
+	b.ircSend("NOTICE " + target + " :" + message)
+}
+
+// dialIRC connects to the IRC server, go-ircevent uses it (irc.Connection.Dial)
+// for every connection. We connect through the configured proxy and do the TLS
+// handshake ourselves, then ask for the capabilities before go-ircevent
+// registers.
+func (b *Bridge) dialIRC(_, address string) (net.Conn, error) {
+	conn, err := b.ircDial(address)
+	if err != nil {
+		return nil, err
+	}
+	if b.Config.IRC.UseTLS {
+		config := b.ircTLS.Clone()
+		if config.ServerName == "" {
+			config.ServerName = b.Config.IRC.Server
+		}
+		tlsconn := tls.Client(conn, config)
+		tlsconn.SetDeadline(time.Now().Add(ircDialTimeout))
+		if err := tlsconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsconn.SetDeadline(time.Time{})
+		conn = tlsconn
+	}
+	// go-ircevent registers right away, ask for the capabilities first so
+	// the server waits for CAP END
+	caps := len(b.wantedCaps()) > 0
+	b.caps.reset(caps)
+	if caps {
+		if _, err := io.WriteString(conn, "CAP LS 302\r\n"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	b.link.set(conn)
+	return conn, nil
+}
+
+// ircLoop reconnects to the IRC server when the connection fails.
+func (b *Bridge) ircLoop() {
+	for {
+		err := <-b.i.ErrorChan()
+		flog.irc.Errorf("Disconnected: %s", err)
+		// also when only writing failed, Reconnect waits for the read loop
+		b.link.close()
+		for {
+			err = b.i.Reconnect()
+			if err == nil {
+				break
+			}
+			flog.irc.Errorf("Reconnecting failed: %s, retrying in %s", err, ircReconnectDelay)
+			time.Sleep(ircReconnectDelay)
+		}
+	}
+}
+
+// handleError handles the ERROR the server sends before closing the connection.
+func (b *Bridge) handleError(event *irc.Event) {
+	flog.irc.Errorf("Server error: %s", event.Message())
+	b.link.close()
+}
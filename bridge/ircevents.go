@@ -0,0 +1,147 @@
+package bridge
+
+import (
+	"strings"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// default templates for relayed IRC events
+const (
+	defaultNoticeFormat = "-{NICK}- {MESSAGE}"
+	defaultKickFormat   = "{TARGET} was kicked from {CHANNEL} by {NICK} ({REASON})"
+	defaultModeFormat   = "{NICK} sets mode {MODE} on {CHANNEL}"
+	defaultQuitFormat   = "{NICK} has quit ({REASON})"
+	defaultNickFormat   = "{NICK} is now known as {NEWNICK}"
+)
+
+// formatEvent replaces the {KEY} placeholders in format by their value in fields.
+func formatEvent(format string, defaultFormat string, fields map[string]string) string {
+	if format == "" {
+		format = defaultFormat
+	}
+	var oldnew []string
+	for k, v := range fields {
+		oldnew = append(oldnew, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(oldnew...).Replace(format)
+}
+
+func (b *Bridge) handleJoin(event *irc.Event) {
+	b.roster.join(event.Arguments[0], event.Nick)
+	if b.isupport.equal(event.Nick, b.ircNick) {
+		b.requestHistory(event.Arguments[0])
+	}
+}
+
+func (b *Bridge) handlePart(event *irc.Event) {
+	if b.isupport.equal(event.Nick, b.ircNick) {
+		b.roster.forget(event.Arguments[0])
+		return
+	}
+	b.roster.part(event.Arguments[0], event.Nick)
+}
+
+func (b *Bridge) handleKick(event *irc.Event) {
+	// KICK <channel> <nick> [:<reason>]
+	if len(event.Arguments) < 2 {
+		return
+	}
+	channel, target := event.Arguments[0], event.Arguments[1]
+	reason := ""
+	if len(event.Arguments) > 2 {
+		reason = event.Arguments[2]
+	}
+	if b.Config.Mattermost.ShowKick {
+		b.sendMM(formatEvent(b.Config.Mattermost.KickFormat, defaultKickFormat, map[string]string{
+			"NICK": b.ircNickFormat(event.Nick), "TARGET": b.ircNickFormat(target),
+			"CHANNEL": channel, "REASON": reason}), channel)
+	}
+	if b.isupport.equal(target, b.ircNick) {
+		flog.irc.Warnf("Kicked from %s by %s (%s)", channel, event.Nick, reason)
+		b.roster.forget(channel)
+		return
+	}
+	b.roster.part(channel, target)
+}
+
+func (b *Bridge) handleQuit(event *irc.Event) {
+	split := isNetsplit(event.Message())
+	for _, channel := range b.roster.quit(event.Nick) {
+		switch {
+		case split && (b.Config.Mattermost.ShowQuit || b.Config.Mattermost.ShowJoinPart):
+			b.joinparts.add(channel, jpSplit, event.Nick, event.Message())
+		case b.Config.Mattermost.ShowQuit && b.joinPartInterval() > 0:
+			b.joinparts.add(channel, jpPart, event.Nick, "")
+		case b.Config.Mattermost.ShowQuit:
+			b.sendMM(formatEvent(b.Config.Mattermost.QuitFormat, defaultQuitFormat, map[string]string{
+				"NICK": b.ircNickFormat(event.Nick), "CHANNEL": channel, "REASON": event.Message()}), channel)
+		}
+	}
+}
+
+func (b *Bridge) handleNick(event *irc.Event) {
+	newnick := event.Message()
+	if b.isupport.equal(event.Nick, b.ircNick) {
+		b.ircNick = newnick
+	}
+	for _, channel := range b.roster.rename(event.Nick, newnick) {
+		if b.Config.Mattermost.ShowNick {
+			b.sendMM(formatEvent(b.Config.Mattermost.NickFormat, defaultNickFormat, map[string]string{
+				"NICK": b.ircNickFormat(event.Nick), "NEWNICK": b.ircNickFormat(newnick), "CHANNEL": channel}), channel)
+		}
+	}
+}
+
+func (b *Bridge) handleMode(event *irc.Event) {
+	// MODE <channel> <modes> [<args>...]
+	if len(event.Arguments) < 2 || !b.isupport.isChannel(event.Arguments[0]) {
+		return
+	}
+	channel := event.Arguments[0]
+	b.updateModes(channel, event.Arguments[1], event.Arguments[2:])
+	if b.Config.Mattermost.ShowMode {
+		nick := event.Nick
+		if nick == "" {
+			// mode set by a server
+			nick = event.Source
+		}
+		b.sendMM(formatEvent(b.Config.Mattermost.ModeFormat, defaultModeFormat, map[string]string{
+			"NICK": b.ircNickFormat(nick), "CHANNEL": channel, "MODE": strings.Join(event.Arguments[1:], " ")}), channel)
+	}
+}
+
+// updateModes applies membership mode changes (+o, -v, ...) to the roster.
+func (b *Bridge) updateModes(channel string, modes string, args []string) {
+	add := true
+	for i := 0; i < len(modes); i++ {
+		switch modes[i] {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			if !b.isupport.modeTakesArg(modes[i], add) {
+				continue
+			}
+			if len(args) == 0 {
+				return
+			}
+			b.roster.setMode(channel, args[0], modes[i], add)
+			args = args[1:]
+		}
+	}
+}
+
+// relayNotice relays a channel NOTICE to mattermost.
+func (b *Bridge) relayNotice(event *irc.Event) {
+	channel := event.Arguments[0]
+	if !b.Config.Mattermost.ShowNotice || !b.isupport.isChannel(channel) || b.isupport.equal(event.Nick, b.ircNick) {
+		return
+	}
+	if b.ignoreMessage(event.Nick, event.Message(), "irc") {
+		return
+	}
+	b.sendMM(formatEvent(b.Config.Mattermost.NoticeFormat, defaultNoticeFormat, map[string]string{
+		"NICK": b.ircNickFormat(event.Nick), "CHANNEL": channel, "MESSAGE": event.Message()}), channel)
+}
@@ -0,0 +1,131 @@
+package bridge
+
+import (
+	"strings"
+	"time"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// ircCaps are the IRCv3 capabilities we request from the server.
+var ircCaps = []string{"server-time", "message-tags", "echo-message", "account-tag", "extended-join", "away-notify", "multi-prefix"}
+
+// IRCMeta holds the IRCv3 metadata of an IRC message relayed to Mattermost.
+type IRCMeta struct {
+	// Nick is the IRC nick of the sender, without RemoteNickFormat.
+	Nick string
+	// Time is the server-time of the message, zero if the server didn't send one.
+	Time    time.Time
+	MsgID   string
+	Account string
+	Away    string
+	// Backlog is true for messages replayed by a bouncer or the server history.
+	Backlog bool
+}
+
+// ircMeta extracts the IRCv3 metadata from event.
+func (b *Bridge) ircMeta(event *irc.Event) *IRCMeta {
+	meta := &IRCMeta{Nick: event.Nick}
+	tags := b.tags(event)
+	if ts, ok := tags["time"]; ok {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			flog.irc.Debugf("Invalid server-time %s: %s", ts, err)
+		} else {
+			meta.Time = t
+		}
+	}
+	meta.MsgID = tags["msgid"]
+	if account, ok := tags["account"]; ok {
+		meta.Account = account
+	} else {
+		meta.Account = b.ircAccounts[event.Nick]
+	}
+	meta.Away = b.ircAway[event.Nick]
+	meta.Backlog = b.isBacklog(event, meta.Time)
+	return meta
+}
+
+// props returns the meta as Mattermost post props.
+func (meta *IRCMeta) props() map[string]interface{} {
+	props := make(map[string]interface{})
+	if !meta.Time.IsZero() {
+		props["irc_time"] = meta.Time.UTC().Format(time.RFC3339Nano)
+	}
+	if meta.MsgID != "" {
+		props["irc_msgid"] = meta.MsgID
+	}
+	if meta.Account != "" {
+		props["irc_account"] = meta.Account
+	}
+	if meta.Away != "" {
+		props["irc_away"] = meta.Away
+	}
+	if meta.Backlog {
+		props["irc_backlog"] = true
+	}
+	return props
+}
+
+// createAt returns the server-time in milliseconds, 0 if unknown.
+func (meta *IRCMeta) createAt() int64 {
+	if meta.Time.IsZero() {
+		return 0
+	}
+	return meta.Time.UnixNano() / int64(time.Millisecond)
+}
+
+// handleEcho handles our own messages echoed back by the server (echo-message).
+func (b *Bridge) handleEcho(event *irc.Event) {
+	flog.irc.Debugf("delivered to %s (msgid: %s)", event.Arguments[0], b.tags(event)["msgid"])
+}
+
+// handleAccountJoin keeps track of the account of joining users (extended-join).
+func (b *Bridge) handleAccountJoin(event *irc.Event) {
+	// JOIN <channel> <account> :<realname>
+	if len(event.Arguments) < 3 {
+		return
+	}
+	b.setAccount(event.Nick, event.Arguments[1])
+}
+
+// handleAccount handles ACCOUNT messages (account-notify).
+func (b *Bridge) handleAccount(event *irc.Event) {
+	if len(event.Arguments) < 1 {
+		return
+	}
+	b.setAccount(event.Nick, event.Arguments[0])
+}
+
+func (b *Bridge) setAccount(nick string, account string) {
+	// "*" means the user is not logged in
+	if account == "*" {
+		delete(b.ircAccounts, nick)
+		return
+	}
+	b.ircAccounts[nick] = account
+}
+
+// handleAway keeps track of away users (away-notify).
+func (b *Bridge) handleAway(event *irc.Event) {
+	msg := strings.TrimSpace(event.Message())
+	if len(event.Arguments) == 0 || msg == "" {
+		delete(b.ircAway, event.Nick)
+		return
+	}
+	b.ircAway[event.Nick] = msg
+}
+
+// handleNickQuit keeps the account and away state in sync with nick changes and quits.
+func (b *Bridge) handleNickQuit(event *irc.Event) {
+	if event.Code == "NICK" {
+		if account, ok := b.ircAccounts[event.Nick]; ok {
+			b.ircAccounts[event.Message()] = account
+		}
+		if away, ok := b.ircAway[event.Nick]; ok {
+			b.ircAway[event.Message()] = away
+		}
+	}
+	delete(b.ircAccounts, event.Nick)
+	delete(b.ircAway, event.Nick)
+}
@@ -0,0 +1,263 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// ircSupport holds the RPL_ISUPPORT (005) parameters of the IRC server.
+// Defaults are the RFC1459 values until the server tells us otherwise.
+type ircSupport struct {
+	sync.RWMutex
+	casemapping string
+	chantypes   string
+	prefixModes string    // channel modes giving a prefix, e.g. "ov"
+	prefixes    string    // matching prefixes, e.g. "@+"
+	chanmodes   [4]string // CHANMODES types A, B, C and D
+	nicklen     int
+	linelen     int
+	targmax     map[string]int
+	chathistory int
+}
+
+func newIRCSupport() *ircSupport {
+	return &ircSupport{
+		casemapping: "rfc1459",
+		chantypes:   "#&",
+		prefixModes: "ov",
+		prefixes:    "@+",
+		chanmodes:   [4]string{"beI", "k", "l", "imnpst"},
+		nicklen:     9,
+		linelen:     512,
+		targmax:     make(map[string]int),
+	}
+}
+
+// parse handles the tokens of one RPL_ISUPPORT line. It returns true if the casemapping changed.
+func (s *ircSupport) parse(tokens []string) bool {
+	s.Lock()
+	defer s.Unlock()
+	changed := false
+	for _, token := range tokens {
+		kv := strings.SplitN(token, "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch kv[0] {
+		case "CASEMAPPING":
+			changed = changed || s.casemapping != value
+			s.casemapping = value
+		case "CHANTYPES":
+			s.chantypes = value
+		case "PREFIX":
+			// PREFIX=(ov)@+
+			if i := strings.Index(value, ")"); strings.HasPrefix(value, "(") && i > 0 {
+				s.prefixModes = value[1:i]
+				s.prefixes = value[i+1:]
+			}
+		case "CHANMODES":
+			for i, modes := range strings.SplitN(value, ",", 4) {
+				s.chanmodes[i] = modes
+			}
+		case "CHATHISTORY", "draft/CHATHISTORY":
+			if n, err := strconv.Atoi(value); err == nil {
+				s.chathistory = n
+			}
+		case "NICKLEN":
+			if n, err := strconv.Atoi(value); err == nil {
+				s.nicklen = n
+			}
+		case "LINELEN":
+			if n, err := strconv.Atoi(value); err == nil {
+				s.linelen = n
+			}
+		case "TARGMAX":
+			// TARGMAX=PRIVMSG:4,NOTICE:4,JOIN:
+			for _, t := range strings.Split(value, ",") {
+				cmd := strings.SplitN(t, ":", 2)
+				if len(cmd) != 2 {
+					continue
+				}
+				n, _ := strconv.Atoi(cmd[1])
+				s.targmax[strings.ToUpper(cmd[0])] = n
+			}
+		}
+	}
+	return changed
+}
+
+// lower folds name according to the server casemapping.
+func (s *ircSupport) lower(name string) string {
+	s.RLock()
+	defer s.RUnlock()
+	switch s.casemapping {
+	case "ascii":
+		return asciiLower(name, "")
+	case "strict-rfc1459":
+		return asciiLower(name, "[]\\")
+	case "rfc1459", "":
+		return asciiLower(name, "[]\\~")
+	}
+	return strings.ToLower(name)
+}
+
+func asciiLower(name string, specials string) string {
+	const upper, lower = "[]\\~", "{}|^"
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		if i := strings.IndexRune(specials, r); i >= 0 {
+			return rune(lower[strings.IndexRune(upper, r)])
+		}
+		return r
+	}, name)
+}
+
+// equal compares nicks or channels case-insensitively.
+func (s *ircSupport) equal(a string, b string) bool {
+	return s.lower(a) == s.lower(b)
+}
+
+// isChannel returns true if name starts with one of the server CHANTYPES.
+func (s *ircSupport) isChannel(name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return name != "" && strings.IndexByte(s.chantypes, name[0]) >= 0
+}
+
+// splitPrefix splits the membership prefixes (@, +, ...) from a NAMES entry.
+func (s *ircSupport) splitPrefix(name string) (string, string) {
+	s.RLock()
+	defer s.RUnlock()
+	i := 0
+	for i < len(name) && strings.IndexByte(s.prefixes, name[i]) >= 0 {
+		i++
+	}
+	return name[:i], name[i:]
+}
+
+// modePrefix returns the prefix belonging to a membership mode (o -> @), 0 if mode isn't one.
+func (s *ircSupport) modePrefix(mode byte) byte {
+	s.RLock()
+	defer s.RUnlock()
+	if i := strings.IndexByte(s.prefixModes, mode); i >= 0 && i < len(s.prefixes) {
+		return s.prefixes[i]
+	}
+	return 0
+}
+
+// prefixRank returns the rank of a membership prefix, 0 is the highest.
+// Regular users ("") rank lowest.
+func (s *ircSupport) prefixRank(prefix string) int {
+	s.RLock()
+	defer s.RUnlock()
+	if prefix == "" {
+		return len(s.prefixes)
+	}
+	if i := strings.Index(s.prefixes, prefix); i >= 0 {
+		return i
+	}
+	return len(s.prefixes)
+}
+
+// sortPrefixes sorts membership prefixes by rank, highest first.
+func (s *ircSupport) sortPrefixes(prefixes string) string {
+	s.RLock()
+	defer s.RUnlock()
+	sorted := ""
+	for i := 0; i < len(s.prefixes); i++ {
+		if strings.IndexByte(prefixes, s.prefixes[i]) >= 0 {
+			sorted += string(s.prefixes[i])
+		}
+	}
+	return sorted
+}
+
+// modeTakesArg returns true if the channel mode takes an argument when set (or unset).
+func (s *ircSupport) modeTakesArg(mode byte, add bool) bool {
+	s.RLock()
+	defer s.RUnlock()
+	switch {
+	case strings.IndexByte(s.prefixModes, mode) >= 0,
+		strings.IndexByte(s.chanmodes[0], mode) >= 0,
+		strings.IndexByte(s.chanmodes[1], mode) >= 0:
+		return true
+	case strings.IndexByte(s.chanmodes[2], mode) >= 0:
+		return add
+	}
+	return false
+}
+
+// historyLimit returns the maximum number of messages for a CHATHISTORY request.
+func (s *ircSupport) historyLimit() int {
+	s.RLock()
+	defer s.RUnlock()
+	if s.chathistory <= 0 {
+		return defaultHistoryLimit
+	}
+	return s.chathistory
+}
+
+// lineBudget returns the number of bytes available for the text of a
+// command like "PRIVMSG <target> :<text>" as relayed by the server to others.
+func (s *ircSupport) lineBudget(command string, target string, nick string) int {
+	s.RLock()
+	defer s.RUnlock()
+	// the server prefixes ":nick!user@host " when relaying, reserve room for
+	// the longest user (10) and host (63) and the trailing CRLF.
+	budget := s.linelen - len(":"+nick+"!@ "+command+" "+target+" :\r\n") - 10 - 63
+	if budget < 64 {
+		budget = 64
+	}
+	return budget
+}
+
+// maxTargets returns the TARGMAX for command, 0 means unlimited.
+func (s *ircSupport) maxTargets(command string) int {
+	s.RLock()
+	defer s.RUnlock()
+	n, ok := s.targmax[command]
+	if !ok {
+		// servers not advertising TARGMAX accept at least one target
+		return 1
+	}
+	return n
+}
+
+func (b *Bridge) handleISupport(event *irc.Event) {
+	// 005 <nick> <tokens...> :are supported by this server
+	if len(event.Arguments) < 3 {
+		return
+	}
+	if b.isupport.parse(event.Arguments[1 : len(event.Arguments)-1]) {
+		flog.irc.Debugf("casemapping changed, rebuilding channel map")
+		b.buildIRCMap()
+	}
+}
+
+// splitText splits text in parts of at most max bytes, preferably on spaces and
+// never inside a UTF-8 sequence.
+func splitText(text string, max int) []string {
+	if max < utf8.UTFMax {
+		return []string{text}
+	}
+	var parts []string
+	for len(text) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if i := strings.LastIndex(text[:cut], " "); i > max/2 {
+			cut = i
+		}
+		parts = append(parts, text[:cut])
+		text = strings.TrimLeft(text[cut:], " ")
+	}
+	return append(parts, text)
+}
@@ -0,0 +1,106 @@
+package bridge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestISupportLower(t *testing.T) {
+	tests := []struct {
+		tokens []string
+		name   string
+		want   string
+	}{
+		{nil, "Nick[]\\~", "nick{}|^"},
+		{[]string{"CASEMAPPING=rfc1459"}, "#Chan[1]", "#chan{1}"},
+		{[]string{"CASEMAPPING=strict-rfc1459"}, "Nick[]\\~", "nick{}|~"},
+		{[]string{"CASEMAPPING=ascii"}, "Nick[]\\~", "nick[]\\~"},
+		{[]string{"CASEMAPPING=rfc7613"}, "NÏCK", "nïck"},
+	}
+	for _, tt := range tests {
+		s := newIRCSupport()
+		s.parse(tt.tokens)
+		if got := s.lower(tt.name); got != tt.want {
+			t.Errorf("%v: lower(%q) = %q, want %q", tt.tokens, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestISupportParse(t *testing.T) {
+	s := newIRCSupport()
+	if !s.parse([]string{"CASEMAPPING=ascii", "CHANTYPES=#", "PREFIX=(qaohv)~&@%+", "CHANMODES=beI,k,l,imnpst",
+		"NICKLEN=30", "LINELEN=1024", "TARGMAX=PRIVMSG:4,NOTICE:4,JOIN:", "draft/CHATHISTORY=100"}) {
+		t.Error("casemapping change not reported")
+	}
+	if s.parse([]string{"CASEMAPPING=ascii"}) {
+		t.Error("unchanged casemapping reported as changed")
+	}
+	if s.casemapping != "ascii" || s.chantypes != "#" || s.nicklen != 30 || s.linelen != 1024 || s.chathistory != 100 {
+		t.Errorf("unexpected parameters %+v", s)
+	}
+	if s.prefixModes != "qaohv" || s.prefixes != "~&@%+" {
+		t.Errorf("PREFIX parsed as %q %q", s.prefixModes, s.prefixes)
+	}
+	if want := [4]string{"beI", "k", "l", "imnpst"}; s.chanmodes != want {
+		t.Errorf("CHANMODES parsed as %q, want %q", s.chanmodes, want)
+	}
+	targets := map[string]int{"PRIVMSG": 4, "NOTICE": 4, "JOIN": 0, "KICK": 1}
+	for command, want := range targets {
+		if got := s.maxTargets(command); got != want {
+			t.Errorf("maxTargets(%s) = %d, want %d", command, got, want)
+		}
+	}
+	if s.isChannel("&local") || !s.isChannel("#chan") {
+		t.Error("isChannel doesn't use CHANTYPES")
+	}
+	if got := s.modePrefix('h'); got != '%' {
+		t.Errorf("modePrefix(h) = %q, want %%", got)
+	}
+}
+
+func TestLineBudget(t *testing.T) {
+	tests := []struct {
+		linelen int
+		command string
+		target  string
+		nick    string
+		want    int
+	}{
+		// 512 - len(":bot!@ PRIVMSG #chan :\r\n") - 10 - 63
+		{512, "PRIVMSG", "#chan", "bot", 415},
+		{512, "NOTICE", "#chan", "bot", 416},
+		{1024, "PRIVMSG", "#chan", "bot", 927},
+		// never less than 64
+		{100, "PRIVMSG", "#chan", "bot", 64},
+	}
+	for _, tt := range tests {
+		s := newIRCSupport()
+		s.linelen = tt.linelen
+		if got := s.lineBudget(tt.command, tt.target, tt.nick); got != tt.want {
+			t.Errorf("lineBudget(%s, %s, %s) with LINELEN=%d = %d, want %d",
+				tt.command, tt.target, tt.nick, tt.linelen, got, tt.want)
+		}
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		text string
+		max  int
+		want []string
+	}{
+		{"hello", 10, []string{"hello"}},
+		{"hello world", 3, []string{"hello world"}},
+		{"aaaa bbbb cccc", 10, []string{"aaaa bbbb", "cccc"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		// a space in the first half isn't worth it
+		{"a bcdefghij", 6, []string{"a bcde", "fghij"}},
+		// don't cut a UTF-8 sequence
+		{"ééééé", 5, []string{"éé", "éé", "é"}},
+	}
+	for _, tt := range tests {
+		if got := splitText(tt.text, tt.max); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitText(%q, %d) = %q, want %q", tt.text, tt.max, got, tt.want)
+		}
+	}
+}
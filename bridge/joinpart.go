@@ -0,0 +1,158 @@
+package bridge
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// netsplitDelay is how long we collect netsplit quits and rejoins before
+	// posting when JoinPartInterval isn't set.
+	netsplitDelay = 5 * time.Second
+	// netsplitExpire is how long we remember nicks that quit in a netsplit.
+	netsplitExpire = 15 * time.Minute
+)
+
+// a netsplit quit message contains the names of the two servers that split, e.g.
+// "irc.example.net hub.example.net" or "*.net *.split"
+var netsplitRe = regexp.MustCompile(`^[\w*-]+(\.[\w*-]+)+ [\w*-]+(\.[\w*-]+)+$`)
+
+func isNetsplit(reason string) bool {
+	return netsplitRe.MatchString(reason)
+}
+
+type joinPartKind int
+
+const (
+	jpJoin joinPartKind = iota
+	jpPart
+	jpSplit
+)
+
+type joinPartBatch struct {
+	channel string
+	changes []string // "+nick" and "-nick" in order
+	splits  int
+	servers string
+	merges  int
+}
+
+// joinPartAggregator collects joins, parts and quits per channel and posts
+// them as one summary after a delay.
+type joinPartAggregator struct {
+	sync.Mutex
+	b       *Bridge
+	batches map[string]*joinPartBatch
+	// splitKey of channel and nick -> time the nick quit in a netsplit
+	splitNicks map[string]time.Time
+}
+
+func newJoinPartAggregator(b *Bridge) *joinPartAggregator {
+	return &joinPartAggregator{b: b, batches: make(map[string]*joinPartBatch), splitNicks: make(map[string]time.Time)}
+}
+
+func (b *Bridge) joinPartInterval() time.Duration {
+	return time.Duration(b.Config.Mattermost.JoinPartInterval) * time.Second
+}
+
+func (a *joinPartAggregator) splitKey(channel string, nick string) string {
+	return a.b.isupport.lower(channel) + " " + a.b.isupport.lower(nick)
+}
+
+// isSplit returns true if nick quit channel in a recent netsplit and didn't rejoin yet.
+func (a *joinPartAggregator) isSplit(channel string, nick string) bool {
+	a.Lock()
+	defer a.Unlock()
+	t, ok := a.splitNicks[a.splitKey(channel, nick)]
+	return ok && time.Since(t) < netsplitExpire
+}
+
+// add records a join, part or netsplit quit of nick on channel. reason is the
+// quit message for netsplits.
+func (a *joinPartAggregator) add(channel string, kind joinPartKind, nick string, reason string) {
+	a.Lock()
+	defer a.Unlock()
+	key := a.b.isupport.lower(channel)
+	batch, ok := a.batches[key]
+	if !ok {
+		batch = &joinPartBatch{channel: channel}
+		a.batches[key] = batch
+		delay := a.b.joinPartInterval()
+		if delay <= 0 {
+			delay = netsplitDelay
+		}
+		time.AfterFunc(delay, func() { a.flush(key) })
+	}
+	split := a.splitKey(channel, nick)
+	switch kind {
+	case jpSplit:
+		a.splitNicks[split] = time.Now()
+		batch.splits++
+		batch.servers = reason
+	case jpJoin:
+		// only the first join after the split is part of the netjoin
+		if t, ok := a.splitNicks[split]; ok {
+			delete(a.splitNicks, split)
+			if time.Since(t) < netsplitExpire {
+				batch.merges++
+				return
+			}
+		}
+		// a part and rejoin in the same batch cancel each other out
+		if !batch.remove("-" + nick) {
+			batch.changes = append(batch.changes, "+"+nick)
+		}
+	case jpPart:
+		if !batch.remove("+" + nick) {
+			batch.changes = append(batch.changes, "-"+nick)
+		}
+	}
+}
+
+func (batch *joinPartBatch) remove(change string) bool {
+	for i, c := range batch.changes {
+		if c == change {
+			batch.changes = append(batch.changes[:i], batch.changes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (batch *joinPartBatch) String() string {
+	var parts []string
+	if len(batch.changes) > 0 {
+		parts = append(parts, strings.Join(batch.changes, " "))
+	}
+	if batch.splits > 0 {
+		parts = append(parts, "(netsplit "+batch.servers+": "+strconv.Itoa(batch.splits)+" users)")
+	}
+	if batch.merges > 0 {
+		parts = append(parts, "(netjoin: "+strconv.Itoa(batch.merges)+" users)")
+	}
+	return strings.Join(parts, " ")
+}
+
+func (a *joinPartAggregator) flush(key string) {
+	a.Lock()
+	batch := a.batches[key]
+	delete(a.batches, key)
+	// forget old netsplits
+	for split, t := range a.splitNicks {
+		if time.Since(t) > netsplitExpire {
+			delete(a.splitNicks, split)
+		}
+	}
+	a.Unlock()
+	if batch == nil {
+		return
+	}
+	text := batch.String()
+	if text == "" {
+		return
+	}
+	a.b.sendMM(text, batch.channel)
+}
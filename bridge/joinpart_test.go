@@ -0,0 +1,104 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsNetsplit(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   bool
+	}{
+		{"irc.example.net hub.example.net", true},
+		{"*.net *.split", true},
+		{"leaf-1.example.org hub.example.org", true},
+		{"Quit: leaving", false},
+		{"Ping timeout: 240 seconds", false},
+		{"Remote host closed the connection", false},
+		// exactly two server names
+		{"irc.example.net", false},
+		{"irc.example.net hub.example.net extra", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isNetsplit(tt.reason); got != tt.want {
+			t.Errorf("isNetsplit(%q) = %v, want %v", tt.reason, got, tt.want)
+		}
+	}
+}
+
+func newTestAggregator() *joinPartAggregator {
+	initFLog()
+	b := &Bridge{Config: &Config{}}
+	b.isupport = newIRCSupport()
+	// batches are posted after netsplitDelay
+	b.mmQueue = make(chan func(), mmQueueSize)
+	return newJoinPartAggregator(b)
+}
+
+func TestJoinPartAggregator(t *testing.T) {
+	const servers = "irc.example.net hub.example.net"
+	type step struct {
+		channel string
+		kind    joinPartKind
+		nick    string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  map[string]string // channel -> summary
+	}{
+		{"joins and parts", []step{
+			{"#a", jpJoin, "alice"}, {"#a", jpPart, "bob"}, {"#a", jpJoin, "carol"},
+		}, map[string]string{"#a": "+alice -bob +carol"}},
+		{"part and rejoin", []step{
+			{"#a", jpJoin, "alice"}, {"#a", jpPart, "alice"}, {"#a", jpPart, "bob"}, {"#a", jpJoin, "bob"},
+		}, map[string]string{"#a": ""}},
+		{"netsplit and netjoin", []step{
+			{"#a", jpSplit, "alice"}, {"#a", jpSplit, "Bob"}, {"#a", jpJoin, "bob"}, {"#a", jpJoin, "carol"},
+		}, map[string]string{"#a": "+carol (netsplit " + servers + ": 2 users) (netjoin: 1 users)"}},
+		{"only the first join is a netjoin", []step{
+			{"#a", jpSplit, "alice"}, {"#a", jpJoin, "alice"}, {"#a", jpPart, "alice"}, {"#a", jpJoin, "alice"},
+		}, map[string]string{"#a": "(netsplit " + servers + ": 1 users) (netjoin: 1 users)"}},
+		{"netjoin per channel", []step{
+			{"#a", jpSplit, "alice"}, {"#b", jpSplit, "alice"}, {"#a", jpJoin, "alice"}, {"#b", jpJoin, "alice"}, {"#c", jpJoin, "alice"},
+		}, map[string]string{
+			"#a": "(netsplit " + servers + ": 1 users) (netjoin: 1 users)",
+			"#b": "(netsplit " + servers + ": 1 users) (netjoin: 1 users)",
+			"#c": "+alice",
+		}},
+	}
+	for _, tt := range tests {
+		a := newTestAggregator()
+		for _, s := range tt.steps {
+			a.add(s.channel, s.kind, s.nick, servers)
+		}
+		for channel, want := range tt.want {
+			if got := a.batches[channel].String(); got != want {
+				t.Errorf("%s: %s summary %q, want %q", tt.name, channel, got, want)
+			}
+		}
+	}
+}
+
+func TestJoinPartAggregatorIsSplit(t *testing.T) {
+	a := newTestAggregator()
+	a.add("#a", jpSplit, "alice", "irc.example.net hub.example.net")
+	a.add("#a", jpSplit, "bob", "irc.example.net hub.example.net")
+	if !a.isSplit("#A", "Alice") || a.isSplit("#b", "alice") {
+		t.Error("netsplit not recorded per channel")
+	}
+	a.add("#a", jpJoin, "alice", "")
+	if a.isSplit("#a", "alice") {
+		t.Error("rejoined nick still split")
+	}
+	a.splitNicks[a.splitKey("#a", "bob")] = time.Now().Add(-netsplitExpire)
+	if a.isSplit("#a", "bob") {
+		t.Error("expired netsplit still active")
+	}
+	a.add("#a", jpJoin, "bob", "")
+	if got, want := a.batches["#a"].String(), "+bob (netsplit irc.example.net hub.example.net: 2 users) (netjoin: 1 users)"; got != want {
+		t.Errorf("summary %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,57 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/mattermost/platform/model"
+)
+
+// setupMMChannels joins (or creates) the mattermost channels we bridge and
+// reports the ones we can't use.
+func (b *Bridge) setupMMChannels() {
+	if b.Config.Mattermost.Channel != "" {
+		if err := b.ensureMMChannel(b.Config.Mattermost.Channel, false, false, ""); err != nil {
+			flog.mm.Errorf("Can not use default channel %s: %s", b.Config.Mattermost.Channel, err)
+		}
+	}
+	for name, val := range b.Config.Channel {
+		if err := b.ensureMMChannel(val.Mattermost, val.Create, val.Private, val.Purpose); err != nil {
+			flog.mm.Errorf("Can not bridge %s to %s (channel %q): %s", val.Mattermost, val.IRC, name, err)
+		}
+	}
+}
+
+// ensureMMChannel makes sure we're a member of channel (see GetChannelId for
+// the syntax), creating it if it doesn't exist and create is set.
+func (b *Bridge) ensureMMChannel(channel string, create bool, private bool, purpose string) error {
+	ctx := context.Background()
+	id := b.mc.GetChannelId(channel, "")
+	if id != "" {
+		err := b.mc.JoinChannelContext(ctx, id)
+		if err != nil {
+			return errors.New("joining failed: " + err.Error())
+		}
+		return nil
+	}
+	if !create {
+		return errors.New("channel not found (private channels need someone to add the bot, or set create=true)")
+	}
+	var teamId string
+	name := channel
+	if i := strings.Index(channel, "/"); i > 0 {
+		if teamId = b.mc.GetTeamId(channel[:i]); teamId == "" {
+			return errors.New("team " + channel[:i] + " not found")
+		}
+		name = channel[i+1:]
+	}
+	if !model.IsValidChannelIdentifier(name) {
+		return errors.New("can not create " + name + ", use lowercase letters, digits, - and _")
+	}
+	flog.mm.Infof("Creating Mattermost channel %s", channel)
+	if _, err := b.mc.CreateChannelContext(ctx, teamId, name, name, purpose, private); err != nil {
+		return errors.New("creating failed: " + err.Error())
+	}
+	return nil
+}
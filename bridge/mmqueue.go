@@ -0,0 +1,38 @@
+package bridge
+
+import (
+	"time"
+)
+
+const (
+	// messages from IRC waiting to be posted to mattermost, more are dropped
+	mmQueueSize = 1000
+	// maximum time to post a message to mattermost
+	mmPostTimeout = 30 * time.Second
+)
+
+// queueMM runs post on the mattermost queue. IRC callbacks run on the
+// go-ircevent read loop and must not wait for mattermost, or we time out on
+// IRC when mattermost is slow.
+func (b *Bridge) queueMM(post func()) {
+	select {
+	case b.mmQueue <- post:
+	default:
+		flog.mm.Error("Too many messages waiting for mattermost, dropping message")
+	}
+}
+
+// sendMM queues message from the bot to the mattermost channel of ircChannel.
+func (b *Bridge) sendMM(message string, ircChannel string) {
+	nick := b.ircNick
+	b.queueMM(func() {
+		b.Send(nick, message, b.getMMChannel(ircChannel))
+	})
+}
+
+// handleMMQueue posts the queued messages in order.
+func (b *Bridge) handleMMQueue() {
+	for post := range b.mmQueue {
+		post()
+	}
+}
@@ -0,0 +1,193 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ircDialer returns the function used to connect to the IRC server (before
+// TLS), through the configured proxy and from BindAddress.
+func (b *Bridge) ircDialer() (func(address string) (net.Conn, error), error) {
+	cfg := b.Config.IRC
+	network := "tcp"
+	switch cfg.IPVersion {
+	case "":
+	case "4", "6":
+		network += cfg.IPVersion
+	default:
+		return nil, errors.New("invalid IPVersion " + cfg.IPVersion + ", valid values are 4 and 6")
+	}
+	dialer := &net.Dialer{Timeout: ircDialTimeout}
+	if cfg.BindAddress != "" {
+		ip := net.ParseIP(cfg.BindAddress)
+		if ip == nil {
+			return nil, errors.New("invalid BindAddress " + cfg.BindAddress)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if cfg.Proxy == "" {
+		return func(address string) (net.Conn, error) {
+			return dialer.Dial(network, address)
+		}, nil
+	}
+	proxy, err := url.Parse(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	var connect func(conn net.Conn, proxy *url.URL, address string) (net.Conn, error)
+	switch proxy.Scheme {
+	case "socks5":
+		connect = socks5Connect
+	case "http":
+		connect = httpConnect
+	default:
+		return nil, errors.New("invalid Proxy " + cfg.Proxy + ", use socks5://host:port or http://host:port")
+	}
+	return func(address string) (net.Conn, error) {
+		flog.irc.Debugf("Connecting to %s through %s proxy %s", address, proxy.Scheme, proxy.Host)
+		conn, err := dialer.Dial(network, proxy.Host)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(ircDialTimeout))
+		pconn, err := connect(conn, proxy, address)
+		if err != nil {
+			conn.Close()
+			return nil, errors.New("proxy " + proxy.Host + ": " + err.Error())
+		}
+		conn.SetDeadline(time.Time{})
+		return pconn, nil
+	}, nil
+}
+
+// socks5Connect asks the SOCKS5 proxy on conn to connect to address (RFC 1928, RFC 1929).
+func socks5Connect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(host) > 255 {
+		return nil, errors.New("hostname too long")
+	}
+	// greeting: version 5, methods "no authentication" and optionally "username/password"
+	methods := []byte{0x00}
+	if proxy.User != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if proxy.User == nil {
+			return nil, errors.New("proxy requires authentication")
+		}
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0x00 {
+			return nil, errors.New("authentication failed")
+		}
+	default:
+		return nil, errors.New("no acceptable authentication method")
+	}
+	// connect request with a domain name, the proxy resolves it
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[1] != 0x00 {
+		return nil, errors.New("connect failed with code " + strconv.Itoa(int(header[1])))
+	}
+	// skip the bound address and port
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return nil, err
+		}
+		skip = int(l[0]) + 2
+	default:
+		return nil, errors.New("invalid address type in reply")
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// bufConn is a net.Conn that first returns what's left in the bufio.Reader.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// httpConnect asks the HTTP proxy on conn to connect to address with the CONNECT method.
+func httpConnect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("CONNECT failed: " + res.Status)
+	}
+	return &bufConn{Conn: conn, r: r}, nil
+}
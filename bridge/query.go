@@ -0,0 +1,100 @@
+package bridge
+
+import (
+	"strings"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// privateSeparator returns the separator between the addressed user and the
+// message in private messages ("username: message").
+func (b *Bridge) privateSeparator() string {
+	if b.Config.General.PrivateMessageSeparator == "" {
+		return ":"
+	}
+	return b.Config.General.PrivateMessageSeparator
+}
+
+// splitPrivate splits "username: message" in username and message.
+func (b *Bridge) splitPrivate(text string) (string, string, bool) {
+	parts := strings.SplitN(text, b.privateSeparator(), 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	user := strings.TrimSpace(parts[0])
+	msg := strings.TrimSpace(parts[1])
+	if user == "" || msg == "" || strings.ContainsAny(user, " \t") {
+		return "", "", false
+	}
+	return user, msg, true
+}
+
+// services we don't answer if ServiceNicks isn't set
+const defaultServiceNicks = "NickServ ChanServ MemoServ OperServ HostServ BotServ"
+
+// isServiceSender returns true for private messages we never answer: from the
+// server (a source without nick!user@host), services (ServiceNicks) or bouncer
+// modules (*status, *playback).
+func (b *Bridge) isServiceSender(event *irc.Event) bool {
+	nick := event.Nick
+	if nick == "" || strings.HasPrefix(nick, "*") {
+		return true
+	}
+	services := b.Config.IRC.ServiceNicks
+	if services == "" {
+		services = defaultServiceNicks
+	}
+	for _, service := range append(strings.Fields(services), b.chanServNick(), b.Config.IRC.NickServNick) {
+		if service != "" && b.isupport.equal(nick, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleQuery relays a private message to the bot on IRC to a Mattermost direct message.
+func (b *Bridge) handleQuery(event *irc.Event) {
+	if b.isServiceSender(event) {
+		flog.irc.Debugf("Ignoring private message from %s: %s", event.Source, event.Message())
+		return
+	}
+	if !b.Config.General.PrivateMessages || b.kind == Legacy {
+		flog.irc.Debugf("Dropping private message from %s", event.Nick)
+		b.ircNotice(event.Nick, "Private messages are not relayed to Mattermost.")
+		return
+	}
+	user, msg, ok := b.splitPrivate(event.Message())
+	if !ok {
+		b.ircNotice(event.Nick, "Usage: /msg "+b.ircNick+" <mattermost username>"+b.privateSeparator()+" <message>")
+		return
+	}
+	if event.Code == "CTCP_ACTION" {
+		msg = formatAction(msg)
+	}
+	nick := event.Nick
+	b.queueMM(func() {
+		userId := b.mc.GetUserId(user)
+		if userId == "" {
+			b.ircNotice(nick, "Unknown Mattermost user "+user)
+			return
+		}
+		flog.irc.Debugf("Sending private message from %s to Mattermost user %s", nick, user)
+		b.mc.SendDirectMessage(userId, b.ircNickFormat(nick)+" "+msg)
+	})
+}
+
+// handleDirectMessage relays a Mattermost direct message to the bot as a private message on IRC.
+func (b *Bridge) handleDirectMessage(message *MMMessage) {
+	if !b.Config.General.PrivateMessages {
+		return
+	}
+	nick, msg, ok := b.splitPrivate(message.Text)
+	if !ok || b.isupport.isChannel(nick) {
+		b.mc.SendDirectMessage(message.UserId, "Usage: <irc nick>"+b.privateSeparator()+" <message>")
+		return
+	}
+	flog.mm.Debugf("Sending private message from %s to IRC user %s", message.Username, nick)
+	for _, part := range splitText(msg, b.isupport.lineBudget("PRIVMSG", nick, b.ircNick)-len(message.Username)-3) {
+		b.ircPrivmsg(nick, "<"+message.Username+"> "+part)
+	}
+}
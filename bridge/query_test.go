@@ -0,0 +1,37 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/thoj/go-ircevent"
+)
+
+func TestIsServiceSender(t *testing.T) {
+	tests := []struct {
+		services string
+		nick     string
+		want     bool
+	}{
+		{"", "", true},
+		{"", "*status", true},
+		{"", "nickserv", true},
+		{"", "ChanServ", true},
+		// not a service, only ends in "serv"
+		{"", "deserv", false},
+		{"", "alice", false},
+		{"Q", "Q", true},
+		{"Q", "MemoServ", false},
+		// ChanServNick and NickServNick are always services
+		{"Q", "ChanServ", true},
+		{"Q", "AuthServ", true},
+	}
+	for _, tt := range tests {
+		b := &Bridge{Config: &Config{}}
+		b.isupport = newIRCSupport()
+		b.Config.IRC.ServiceNicks = tt.services
+		b.Config.IRC.NickServNick = "AuthServ"
+		if got := b.isServiceSender(&irc.Event{Nick: tt.nick}); got != tt.want {
+			t.Errorf("isServiceSender(%q) with ServiceNicks=%q = %v, want %v", tt.nick, tt.services, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package bridge
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ircMember is a nick on an IRC channel with its membership prefixes
+// (e.g. "@+"), highest rank first.
+type ircMember struct {
+	Nick     string
+	Prefixes string
+}
+
+// Prefix returns the highest membership prefix, "" for regular users.
+func (m *ircMember) Prefix() string {
+	if m.Prefixes == "" {
+		return ""
+	}
+	return m.Prefixes[:1]
+}
+
+// ircRoster keeps track of the nicks in the IRC channels we're on.
+type ircRoster struct {
+	sync.RWMutex
+	isupport *ircSupport
+	// lowered channel -> lowered nick -> member
+	channels map[string]map[string]*ircMember
+}
+
+func newIRCRoster(isupport *ircSupport) *ircRoster {
+	return &ircRoster{isupport: isupport, channels: make(map[string]map[string]*ircMember)}
+}
+
+func (r *ircRoster) join(channel string, nick string) {
+	r.Lock()
+	defer r.Unlock()
+	c := r.isupport.lower(channel)
+	if r.channels[c] == nil {
+		r.channels[c] = make(map[string]*ircMember)
+	}
+	r.channels[c][r.isupport.lower(nick)] = &ircMember{Nick: nick}
+}
+
+func (r *ircRoster) part(channel string, nick string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.channels[r.isupport.lower(channel)], r.isupport.lower(nick))
+}
+
+// forget removes a channel we left.
+func (r *ircRoster) forget(channel string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.channels, r.isupport.lower(channel))
+}
+
+// quit removes nick from all channels and returns the channels nick was on.
+func (r *ircRoster) quit(nick string) []string {
+	r.Lock()
+	defer r.Unlock()
+	n := r.isupport.lower(nick)
+	var channels []string
+	for c, nicks := range r.channels {
+		if _, ok := nicks[n]; ok {
+			delete(nicks, n)
+			channels = append(channels, c)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// rename renames nick to newnick and returns the channels nick is on.
+func (r *ircRoster) rename(nick string, newnick string) []string {
+	r.Lock()
+	defer r.Unlock()
+	n := r.isupport.lower(nick)
+	var channels []string
+	for c, nicks := range r.channels {
+		if m, ok := nicks[n]; ok {
+			delete(nicks, n)
+			m.Nick = newnick
+			nicks[r.isupport.lower(newnick)] = m
+			channels = append(channels, c)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// setNames replaces the nicks of channel with the result of a NAMES reply.
+func (r *ircRoster) setNames(channel string, names []string) {
+	r.Lock()
+	defer r.Unlock()
+	nicks := make(map[string]*ircMember)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		prefixes, nick := r.isupport.splitPrefix(name)
+		nicks[r.isupport.lower(nick)] = &ircMember{Nick: nick, Prefixes: r.isupport.sortPrefixes(prefixes)}
+	}
+	r.channels[r.isupport.lower(channel)] = nicks
+}
+
+// setMode adds (or removes) the prefix belonging to the membership mode (e.g. o or v) of nick on channel.
+func (r *ircRoster) setMode(channel string, nick string, mode byte, add bool) {
+	prefix := r.isupport.modePrefix(mode)
+	if prefix == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	m, ok := r.channels[r.isupport.lower(channel)][r.isupport.lower(nick)]
+	if !ok {
+		return
+	}
+	prefixes := strings.Replace(m.Prefixes, string(prefix), "", -1)
+	if add {
+		prefixes += string(prefix)
+	}
+	m.Prefixes = r.isupport.sortPrefixes(prefixes)
+}
+
+// members returns a copy of the members of channel, sorted by rank and nick.
+func (r *ircRoster) members(channel string) []ircMember {
+	r.RLock()
+	var members []ircMember
+	for _, m := range r.channels[r.isupport.lower(channel)] {
+		members = append(members, *m)
+	}
+	r.RUnlock()
+	sort.Slice(members, func(i, j int) bool {
+		ri, rj := r.isupport.prefixRank(members[i].Prefix()), r.isupport.prefixRank(members[j].Prefix())
+		if ri != rj {
+			return ri < rj
+		}
+		return r.isupport.lower(members[i].Nick) < r.isupport.lower(members[j].Nick)
+	})
+	return members
+}
+
+// known returns true if we have a roster for channel.
+func (r *ircRoster) known(channel string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	_, ok := r.channels[r.isupport.lower(channel)]
+	return ok
+}
@@ -0,0 +1,94 @@
+package bridge
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thoj/go-ircevent"
+)
+
+func newTestRosterBridge(tokens ...string) *Bridge {
+	b := &Bridge{Config: &Config{}}
+	b.isupport = newIRCSupport()
+	b.isupport.parse(tokens)
+	b.roster = newIRCRoster(b.isupport)
+	b.MMirc.names = make(map[string][]string)
+	return b
+}
+
+// names runs the NAMES replies (353) and the end of NAMES (366) of channel.
+func names(b *Bridge, channel string, replies ...string) {
+	for _, reply := range replies {
+		b.storeNames(&irc.Event{Code: "353", Arguments: []string{"bot", "=", channel, reply}})
+	}
+	b.endNames(&irc.Event{Code: "366", Arguments: []string{"bot", channel, "End of /NAMES list."}})
+}
+
+func TestRosterNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		tokens  []string
+		replies []string
+		want    []ircMember
+	}{
+		{"default prefixes", nil, []string{"@op +voice user"},
+			[]ircMember{{"op", "@"}, {"voice", "+"}, {"user", ""}}},
+		// multi-prefix sends all prefixes, in any order we sort them by rank
+		{"multi-prefix", nil, []string{"@+both +@both2 +voice"},
+			[]ircMember{{"both", "@+"}, {"both2", "@+"}, {"voice", "+"}}},
+		{"more prefixes", []string{"PREFIX=(qaohv)~&@%+"}, []string{"%half ~&owner @op +voice"},
+			[]ircMember{{"owner", "~&"}, {"op", "@"}, {"half", "%"}, {"voice", "+"}}},
+		// ~ isn't a prefix without PREFIX
+		{"unknown prefix", nil, []string{"~nick"},
+			[]ircMember{{"~nick", ""}}},
+		{"several replies", nil, []string{"@b a", "c ", " @a2"},
+			[]ircMember{{"a2", "@"}, {"b", "@"}, {"a", ""}, {"c", ""}}},
+	}
+	for _, tt := range tests {
+		b := newTestRosterBridge(tt.tokens...)
+		names(b, "#chan", tt.replies...)
+		if got := b.roster.members("#Chan"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: members = %v, want %v", tt.name, got, tt.want)
+		}
+		if b.MMirc.names["#chan"] != nil {
+			t.Errorf("%s: NAMES replies kept after the end of NAMES", tt.name)
+		}
+	}
+}
+
+func TestRosterNamesReplaces(t *testing.T) {
+	b := newTestRosterBridge()
+	names(b, "#chan", "@old")
+	names(b, "#chan", "new")
+	if got, want := b.roster.members("#chan"), []ircMember{{"new", ""}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", got, want)
+	}
+}
+
+func TestUpdateModes(t *testing.T) {
+	tests := []struct {
+		name  string
+		modes string
+		args  []string
+		want  []ircMember
+	}{
+		{"op", "+o", []string{"b"}, []ircMember{{"a", "@+"}, {"b", "@"}, {"c", "+"}}},
+		{"deop", "-o", []string{"a"}, []ircMember{{"a", "+"}, {"c", "+"}, {"b", ""}}},
+		{"several", "+ov-v", []string{"b", "b", "a"}, []ircMember{{"a", "@"}, {"b", "@+"}, {"c", "+"}}},
+		{"add twice", "+vv", []string{"c", "c"}, []ircMember{{"a", "@+"}, {"c", "+"}, {"b", ""}}},
+		// k and b take an argument, l only when set, n never
+		{"with channel modes", "+kbnlo", []string{"key", "*!*@host", "10", "b"}, []ircMember{{"a", "@+"}, {"b", "@"}, {"c", "+"}}},
+		{"unset limit", "-lo", []string{"a"}, []ircMember{{"a", "+"}, {"c", "+"}, {"b", ""}}},
+		{"unknown nick", "+o", []string{"x"}, []ircMember{{"a", "@+"}, {"c", "+"}, {"b", ""}}},
+		{"missing argument", "+ov", []string{"b"}, []ircMember{{"a", "@+"}, {"b", "@"}, {"c", "+"}}},
+		{"case insensitive", "+o", []string{"B"}, []ircMember{{"a", "@+"}, {"b", "@"}, {"c", "+"}}},
+	}
+	for _, tt := range tests {
+		b := newTestRosterBridge("CHANMODES=beI,k,l,imnpst")
+		names(b, "#chan", "@+a b +c")
+		b.updateModes("#chan", tt.modes, tt.args)
+		if got := b.roster.members("#chan"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %s %v: members = %v, want %v", tt.name, tt.modes, tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package bridge
+
+import (
+	"encoding/base64"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// saslMech returns the SASL mechanism we use: EXTERNAL authenticates with the
+// TLS client certificate (CertFP), PLAIN with the NickServ password.
+func (b *Bridge) saslMech() string {
+	if b.Config.IRC.TLSClientCertificate != "" {
+		return "EXTERNAL"
+	}
+	return "PLAIN"
+}
+
+// startSASL authenticates after the server acknowledged the sasl capability,
+// the capability negotiation ends when the authentication is done.
+func (b *Bridge) startSASL() {
+	b.ircSendf("AUTHENTICATE %s", b.saslMech())
+}
+
+func (b *Bridge) handleAuthenticate(event *irc.Event) {
+	if event.Message() != "+" {
+		return
+	}
+	if b.saslMech() == "EXTERNAL" {
+		// the identity is taken from the TLS client certificate
+		b.ircSend("AUTHENTICATE +")
+		return
+	}
+	login := b.Config.IRC.Nick
+	str := login + "\x00" + login + "\x00" + b.Config.IRC.NickServPassword
+	b.ircSendf("AUTHENTICATE %s", base64.StdEncoding.EncodeToString([]byte(str)))
+}
+
+// setupSASL registers the SASL callbacks.
+// 903: RPL_SASLSUCCESS, 902/904-907: SASL failed or aborted, registration
+// continues without SASL.
+func (b *Bridge) setupSASL(i *irc.Connection) {
+	i.AddCallback("AUTHENTICATE", b.handleAuthenticate)
+	i.AddCallback("903", func(e *irc.Event) {
+		flog.irc.Infof("SASL %s authentication successful", b.saslMech())
+		b.endCaps()
+	})
+	for _, code := range []string{"902", "904", "905", "906", "907"} {
+		i.AddCallback(code, func(e *irc.Event) {
+			flog.irc.Errorf("SASL authentication failed: %s", e.Message())
+			b.endCaps()
+		})
+	}
+}
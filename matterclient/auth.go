@@ -0,0 +1,125 @@
+package matterclient
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// AuthState is the state of our session, see OnAuthState.
+type AuthState int
+
+const (
+	// AuthOK means we're (again) logged in.
+	AuthOK AuthState = iota
+	// AuthExpired means the server rejected our session, we're logging in again.
+	AuthExpired
+	// AuthFailed means we can't login again (token credentials or a bad password),
+	// the client stops like after Logout.
+	AuthFailed
+)
+
+func (s AuthState) String() string {
+	switch s {
+	case AuthOK:
+		return "ok"
+	case AuthExpired:
+		return "expired"
+	case AuthFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// AuthStateFunc is called when the state of our session changes, err is the cause
+// for AuthExpired and AuthFailed.
+type AuthStateFunc func(state AuthState, err error)
+
+// OnAuthState registers fn for changes of the session state. fn is called
+// synchronously while re-authenticating, it should not block.
+func (m *MMClient) OnAuthState(fn AuthStateFunc) {
+	m.handlersMu.Lock()
+	defer m.handlersMu.Unlock()
+	m.authHandlers = append(m.authHandlers, fn)
+}
+
+func (m *MMClient) setAuthState(state AuthState, err error) {
+	m.handlersMu.RLock()
+	handlers := append([]AuthStateFunc(nil), m.authHandlers...)
+	m.handlersMu.RUnlock()
+	for _, fn := range handlers {
+		fn(state, err)
+	}
+}
+
+// canRelogin returns true if we have a password to get a new session with.
+// Tokens (also MMAUTHTOKEN= passwords) can't be renewed by us.
+func (m *MMClient) canRelogin() bool {
+	return m.Credentials.Token == "" && !strings.Contains(m.Credentials.Pass, model.SESSION_COOKIE_TOKEN)
+}
+
+// sessionCheckTimeout bounds the request checking that our session really expired.
+const sessionCheckTimeout = 30 * time.Second
+
+// sessionExpired is called by the API client when the server rejects token.
+// It runs detached from the request that got rejected, that request already
+// returned its error to the caller.
+func (m *MMClient) sessionExpired(token string, cause error) {
+	m.reauthMu.Lock()
+	defer m.reauthMu.Unlock()
+	if m.quitting() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sessionCheckTimeout)
+	defer cancel()
+	client := m.client(ctx)
+	// we already have a new session
+	if client.AuthToken != token {
+		return
+	}
+	if _, err := client.GetMe(); !IsSessionExpired(err) {
+		return
+	}
+	// the websocket uses the same session, WsReceiver notices it was replaced
+	if conn := m.wsConn(); conn != nil {
+		conn.Close()
+	}
+	if m.reauthenticate(cause) == nil {
+		m.resync()
+	}
+}
+
+// reauthenticate logs in again after our session expired, the caller holds reauthMu.
+func (m *MMClient) reauthenticate(cause error) error {
+	m.setConnected(false)
+	if !m.canRelogin() {
+		m.log.Errorf("session token for %s is no longer valid (%s), login with a new token", m.Credentials.Server, cause)
+		m.stop()
+		m.setAuthState(AuthFailed, cause)
+		return cause
+	}
+	m.log.Infof("session expired (%s), logging in again", cause)
+	m.setAuthState(AuthExpired, cause)
+	if err := m.Login(); err != nil {
+		m.log.Errorf("login as %s on %s failed, giving up: %s", m.Credentials.Login, m.Credentials.Server, err)
+		m.stop()
+		m.setAuthState(AuthFailed, err)
+		return err
+	}
+	m.setAuthState(AuthOK, nil)
+	return nil
+}
+
+// stop closes the websocket and makes WsReceiver return.
+func (m *MMClient) stop() {
+	m.wsMu.Lock()
+	defer m.wsMu.Unlock()
+	m.WsQuit = true
+	m.WsConnected = false
+	if m.WsClient != nil {
+		m.WsClient.Close()
+		m.WsClient = nil
+	}
+}
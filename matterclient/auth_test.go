@@ -0,0 +1,135 @@
+package matterclient
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAuthServer answers /users/me with meStatus and rejects logins. It
+// counts the requests by path.
+func fakeAuthServer(meStatus int) (*httptest.Server, func(path string) int) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case apiURLSuffix + "/users/me":
+			w.WriteHeader(meStatus)
+			if meStatus == http.StatusOK {
+				w.Write([]byte(`{"id":"u1","username":"bot"}`))
+			}
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	return srv, func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[apiURLSuffix+path]
+	}
+}
+
+// newAuthTestClient returns a client logged in on srv with token, recording its auth states.
+func newAuthTestClient(srv *httptest.Server, token string, creds *Credentials) (*MMClient, func() []AuthState) {
+	m := New(creds.Login, creds.Pass, creds.Team, strings.TrimPrefix(srv.URL, "http://"))
+	m.Credentials.Token = creds.Token
+	m.NoTLS = true
+	m.Client = NewClient(srv.URL)
+	m.Client.SetToken(token)
+	var mu sync.Mutex
+	var states []AuthState
+	m.OnAuthState(func(state AuthState, err error) {
+		mu.Lock()
+		states = append(states, state)
+		mu.Unlock()
+	})
+	return m, func() []AuthState {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]AuthState(nil), states...)
+	}
+}
+
+// expireConcurrently runs sessionExpired for token from n goroutines.
+func expireConcurrently(m *MMClient, token string, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.sessionExpired(token, errors.New("session expired"))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSessionExpiredReloginOnce(t *testing.T) {
+	srv, requests := fakeAuthServer(http.StatusUnauthorized)
+	defer srv.Close()
+	m, states := newAuthTestClient(srv, "old", &Credentials{Login: "bot", Pass: "secret", Team: "team"})
+	expireConcurrently(m, "old", 5)
+	if got := requests("/users/login"); got != 1 {
+		t.Errorf("logged in %d times, want 1", got)
+	}
+	if got := requests("/users/me"); got != 1 {
+		t.Errorf("checked the session %d times, want 1", got)
+	}
+	if got, want := states(), []AuthState{AuthExpired, AuthFailed}; !reflect.DeepEqual(got, want) {
+		t.Errorf("auth states %v, want %v", got, want)
+	}
+	if !m.quitting() {
+		t.Error("client not stopped after the login failed")
+	}
+}
+
+func TestSessionExpiredToken(t *testing.T) {
+	srv, requests := fakeAuthServer(http.StatusUnauthorized)
+	defer srv.Close()
+	m, states := newAuthTestClient(srv, "token", &Credentials{Token: "token", Team: "team"})
+	expireConcurrently(m, "token", 5)
+	if got := requests("/users/login"); got != 0 {
+		t.Errorf("logged in %d times with a token", got)
+	}
+	if got := requests("/users/me"); got != 1 {
+		t.Errorf("checked the session %d times, want 1", got)
+	}
+	if got, want := states(), []AuthState{AuthFailed}; !reflect.DeepEqual(got, want) {
+		t.Errorf("auth states %v, want %v", got, want)
+	}
+}
+
+func TestSessionExpiredIgnored(t *testing.T) {
+	tests := []struct {
+		name     string
+		meStatus int
+		token    string
+		me       int
+	}{
+		// another caller already logged in again
+		{"replaced session", http.StatusUnauthorized, "new", 0},
+		// the request was rejected for another reason
+		{"session still valid", http.StatusOK, "old", 1},
+	}
+	for _, tt := range tests {
+		srv, requests := fakeAuthServer(tt.meStatus)
+		m, states := newAuthTestClient(srv, tt.token, &Credentials{Login: "bot", Pass: "secret", Team: "team"})
+		expireConcurrently(m, "old", 3)
+		if got := requests("/users/me"); got != tt.me*3 {
+			t.Errorf("%s: checked the session %d times, want %d", tt.name, got, tt.me*3)
+		}
+		if got := requests("/users/login"); got != 0 {
+			t.Errorf("%s: logged in %d times", tt.name, got)
+		}
+		if got := states(); len(got) != 0 {
+			t.Errorf("%s: auth states %v", tt.name, got)
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,244 @@
+package matterclient
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mattermost/platform/model"
+)
+
+// channelEntry is a channel in our channel index.
+type channelEntry struct {
+	channel *model.Channel
+	// team whose channel list contains the channel (also set for DM channels)
+	teamId string
+	member bool
+}
+
+// reindex rebuilds the channel and username indexes, call with the lock held.
+func (m *MMClient) reindex() {
+	m.reindexChannels()
+	m.reindexUsers()
+}
+
+// reindexUsers rebuilds the username index, call with the lock held.
+func (m *MMClient) reindexUsers() {
+	m.usernames = make(map[string]string)
+	for id, u := range m.Users {
+		m.usernames[strings.ToLower(u.Username)] = id
+	}
+}
+
+// reindexChannels rebuilds the channel indexes, call with the lock held.
+func (m *MMClient) reindexChannels() {
+	m.channelsById = make(map[string]*channelEntry)
+	m.channelIds = make(map[string]string)
+	m.channelDisplayIds = make(map[string]string)
+	for _, t := range m.OtherTeams {
+		for _, list := range []*model.ChannelList{t.MoreChannels, t.Channels} {
+			if list == nil {
+				continue
+			}
+			for _, c := range list.Channels {
+				m.indexChannel(t.Id, c, list == t.Channels)
+			}
+		}
+	}
+}
+
+// indexChannel adds c from the channel list of teamId to the channel
+// indexes, call with the lock held.
+func (m *MMClient) indexChannel(teamId string, c *model.Channel, member bool) {
+	m.channelIds[teamId+"/"+c.Name] = c.Id
+	if c.DisplayName != "" {
+		m.channelDisplayIds[teamId+"/"+strings.ToLower(c.DisplayName)] = c.Id
+	}
+	// a DM channel is in the list of every team, keep the first one
+	if e, ok := m.channelsById[c.Id]; ok && e.member && e.teamId != teamId {
+		return
+	}
+	m.channelsById[c.Id] = &channelEntry{channel: c, teamId: teamId, member: member}
+}
+
+// unindexChannel removes the names of c in teamId from the channel indexes,
+// call with the lock held.
+func (m *MMClient) unindexChannel(teamId string, c *model.Channel) {
+	if key := teamId + "/" + c.Name; m.channelIds[key] == c.Id {
+		delete(m.channelIds, key)
+	}
+	if key := teamId + "/" + strings.ToLower(c.DisplayName); m.channelDisplayIds[key] == c.Id {
+		delete(m.channelDisplayIds, key)
+	}
+}
+
+// replaceTeam replaces the team with the same id as t and rebuilds the
+// channel indexes, call with the lock held.
+func (m *MMClient) replaceTeam(t *Team) {
+	m.swapTeam(t)
+	m.reindexChannels()
+}
+
+// swapTeam replaces the team with the same id as t without touching the
+// indexes, call with the lock held.
+func (m *MMClient) swapTeam(t *Team) {
+	if m.Team != nil && m.Team.Id == t.Id {
+		m.Team = t
+	}
+	teams := make([]*Team, len(m.OtherTeams))
+	copy(teams, m.OtherTeams)
+	for i, old := range teams {
+		if old.Id == t.Id {
+			teams[i] = t
+		}
+	}
+	m.OtherTeams = teams
+}
+
+// setChannel adds or replaces channel in the team it belongs to, as a channel
+// we're a member of or not. A nil channel removes channelId. Only the index
+// entries of channelId are updated.
+func (m *MMClient) setChannel(channelId string, channel *model.Channel, member bool) {
+	m.Lock()
+	defer m.Unlock()
+	var team *Team
+	if e, ok := m.channelsById[channelId]; ok {
+		team = m.findTeam(e.teamId)
+	} else if channel != nil {
+		team = m.findTeam(channel.TeamId)
+	}
+	if team == nil {
+		// DM and group channels have no team
+		team = m.Team
+	}
+	if team == nil {
+		return
+	}
+	t := *team
+	channels := &model.ChannelList{Members: make(map[string]*model.ChannelMember)}
+	for id, cm := range team.Channels.Members {
+		if id != channelId {
+			channels.Members[id] = cm
+		}
+	}
+	for _, c := range team.Channels.Channels {
+		if c.Id != channelId {
+			channels.Channels = append(channels.Channels, c)
+		} else {
+			m.unindexChannel(team.Id, c)
+		}
+	}
+	moreChannels := &model.ChannelList{Members: make(map[string]*model.ChannelMember)}
+	for _, c := range team.MoreChannels.Channels {
+		if c.Id != channelId {
+			moreChannels.Channels = append(moreChannels.Channels, c)
+		} else {
+			m.unindexChannel(team.Id, c)
+		}
+	}
+	switch {
+	case channel != nil && member:
+		channels.Channels = append(channels.Channels, channel)
+		if cm, ok := team.Channels.Members[channelId]; ok {
+			channels.Members[channelId] = cm
+		} else {
+			channels.Members[channelId] = &model.ChannelMember{ChannelId: channelId, UserId: m.User.Id}
+		}
+		m.indexChannel(team.Id, channel, true)
+	case channel != nil && channel.Type == model.CHANNEL_OPEN:
+		moreChannels.Channels = append(moreChannels.Channels, channel)
+		m.indexChannel(team.Id, channel, false)
+	default:
+		// removed, or a private channel we're no longer in
+		if e, ok := m.channelsById[channelId]; ok && e.teamId == team.Id {
+			delete(m.channelsById, channelId)
+		}
+	}
+	t.Channels = channels
+	t.MoreChannels = moreChannels
+	m.swapTeam(&t)
+}
+
+// findTeam returns the team with teamId, call with the lock held.
+func (m *MMClient) findTeam(teamId string) *Team {
+	for _, t := range m.OtherTeams {
+		if t.Id == teamId {
+			return t
+		}
+	}
+	return nil
+}
+
+// isMember returns true if we're a member of channelId.
+func (m *MMClient) isMember(channelId string) bool {
+	m.RLock()
+	defer m.RUnlock()
+	e, ok := m.channelsById[channelId]
+	return ok && e.member
+}
+
+// fetchChannel gets channelId from the server and adds it to our channels.
+func (m *MMClient) fetchChannel(ctx context.Context, channelId string, member bool) error {
+	channel, err := m.client(ctx).GetChannel(channelId)
+	if err != nil {
+		m.log.Errorf("getting channel %s failed: %s", channelId, err)
+		return err
+	}
+	m.setChannel(channelId, channel, member)
+	return nil
+}
+
+// setUser adds or replaces user in the user cache.
+func (m *MMClient) setUser(user *model.User) {
+	m.Lock()
+	defer m.Unlock()
+	if old, ok := m.Users[user.Id]; ok {
+		delete(m.usernames, strings.ToLower(old.Username))
+	}
+	m.Users[user.Id] = user
+	m.usernames[strings.ToLower(user.Username)] = user.Id
+	if m.userCache == nil {
+		return
+	}
+	if evicted, ok := m.userCache.add(user.Id); ok {
+		if old, ok := m.Users[evicted]; ok {
+			delete(m.usernames, strings.ToLower(old.Username))
+		}
+		delete(m.Users, evicted)
+	}
+}
+
+// loadTeam fetches the channels of a team we didn't load at login (LazyLoad).
+func (m *MMClient) loadTeam(ctx context.Context, teamId string) error {
+	m.log.Debugf("loading channels of team %s", teamId)
+	channels, moreChannels, err := m.getChannels(m.client(ctx), m.userId(), teamId)
+	if err != nil {
+		m.log.Errorf("loading team %s failed: %s", teamId, err)
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	team := m.findTeam(teamId)
+	if team == nil {
+		return nil
+	}
+	t := *team
+	t.Channels = channels
+	t.MoreChannels = moreChannels
+	t.loaded = true
+	m.replaceTeam(&t)
+	return nil
+}
+
+// fetchUser returns userId from the cache, getting it from the server if we don't know it.
+func (m *MMClient) fetchUser(ctx context.Context, userId string) *model.User {
+	if user := m.GetUser(userId); user != nil {
+		return user
+	}
+	user, err := m.client(ctx).GetUser(userId)
+	if err != nil {
+		m.log.Errorf("getting user %s failed: %s", userId, err)
+		return nil
+	}
+	m.setUser(user)
+	return user
+}
@@ -0,0 +1,62 @@
+package matterclient
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mattermost/platform/model"
+)
+
+func testClient() *MMClient {
+	open := &model.Channel{Id: "c1", TeamId: "t1", Name: "town-square", DisplayName: "Town Square", Type: model.CHANNEL_OPEN}
+	private := &model.Channel{Id: "c2", TeamId: "t1", Name: "secret", DisplayName: "Secret", Type: model.CHANNEL_PRIVATE}
+	more := &model.Channel{Id: "c3", TeamId: "t1", Name: "random", DisplayName: "Random", Type: model.CHANNEL_OPEN}
+	dm := &model.Channel{Id: "c4", Name: "u1__u2", Type: model.CHANNEL_DIRECT}
+	other := &model.Channel{Id: "c5", TeamId: "t2", Name: "town-square", DisplayName: "Town Square", Type: model.CHANNEL_OPEN}
+	t1 := &Team{Id: "t1",
+		Channels:     &model.ChannelList{Channels: []*model.Channel{open, private, dm}, Members: map[string]*model.ChannelMember{}},
+		MoreChannels: &model.ChannelList{Channels: []*model.Channel{more}}}
+	t2 := &Team{Id: "t2",
+		Channels:     &model.ChannelList{Channels: []*model.Channel{other, dm}, Members: map[string]*model.ChannelMember{}},
+		MoreChannels: &model.ChannelList{}}
+	m := &MMClient{Team: t1, OtherTeams: []*Team{t1, t2}, User: &model.User{Id: "u1"}, Users: map[string]*model.User{}}
+	m.reindex()
+	return m
+}
+
+// TestSetChannelIndexes checks that the indexes setChannel updates match a full reindex.
+func TestSetChannelIndexes(t *testing.T) {
+	tests := []struct {
+		name      string
+		channelId string
+		channel   *model.Channel
+		member    bool
+	}{
+		{"rename", "c1", &model.Channel{Id: "c1", TeamId: "t1", Name: "lobby", DisplayName: "Lobby", Type: model.CHANNEL_OPEN}, true},
+		{"leave public", "c1", &model.Channel{Id: "c1", TeamId: "t1", Name: "town-square", DisplayName: "Town Square", Type: model.CHANNEL_OPEN}, false},
+		{"leave private", "c2", &model.Channel{Id: "c2", TeamId: "t1", Name: "secret", DisplayName: "Secret", Type: model.CHANNEL_PRIVATE}, false},
+		{"join", "c3", &model.Channel{Id: "c3", TeamId: "t1", Name: "random", DisplayName: "Random", Type: model.CHANNEL_OPEN}, true},
+		{"new", "c6", &model.Channel{Id: "c6", TeamId: "t2", Name: "new", DisplayName: "New", Type: model.CHANNEL_OPEN}, true},
+		{"delete", "c1", nil, false},
+		{"delete unjoined", "c3", nil, false},
+		{"update dm", "c4", &model.Channel{Id: "c4", Name: "u1__u2", Type: model.CHANNEL_DIRECT}, true},
+	}
+	for _, tt := range tests {
+		m := testClient()
+		m.setChannel(tt.channelId, tt.channel, tt.member)
+		want := &MMClient{OtherTeams: m.OtherTeams, Users: m.Users}
+		want.reindex()
+		if !reflect.DeepEqual(m.channelIds, want.channelIds) {
+			t.Errorf("%s: channelIds = %v, want %v", tt.name, m.channelIds, want.channelIds)
+		}
+		if !reflect.DeepEqual(m.channelDisplayIds, want.channelDisplayIds) {
+			t.Errorf("%s: channelDisplayIds = %v, want %v", tt.name, m.channelDisplayIds, want.channelDisplayIds)
+		}
+		if !reflect.DeepEqual(m.channelsById, want.channelsById) {
+			t.Errorf("%s: channelsById differs from a full reindex", tt.name)
+		}
+		if m.Team != m.OtherTeams[0] {
+			t.Errorf("%s: Team not replaced", tt.name)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package matterclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	apiURLSuffix = "/api/v4"
+	// maximum page size of the v4 API
+	perPage = 200
+	// maximum time of a single request, including reading the response
+	httpTimeout = time.Minute
+)
+
+// Client is a minimal client for the Mattermost API v4.
+type Client struct {
+	URL        string // https://server
+	APIURL     string // https://server/api/v4
+	HttpClient *http.Client
+	AuthToken  string
+	ctx        context.Context
+	limiter    *rateLimiter
+	// called (in a goroutine) when the server rejects AuthToken
+	onSessionExpired func(token string, err error)
+}
+
+func NewClient(url string) *Client {
+	return &Client{URL: url, APIURL: url + apiURLSuffix, HttpClient: &http.Client{Timeout: httpTimeout}, ctx: context.Background(),
+		limiter: &rateLimiter{}}
+}
+
+// WithContext returns a copy of the client making its requests with ctx.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+// do makes an API request. body (if not nil) is sent as JSON and the JSON
+// response is decoded in out (if not nil). Errors are returned as *Error,
+// except for the error of the context when it's done.
+func (c *Client) do(method string, path string, body interface{}, out interface{}) (*http.Response, error) {
+	var rbody []byte
+	contentType := ""
+	if body != nil {
+		var err error
+		if rbody, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+		contentType = "application/json"
+	}
+	rp, err := c.doRaw(method, path, contentType, rbody)
+	if err != nil {
+		return rp, err
+	}
+	defer rp.Body.Close()
+	if out != nil {
+		if err := decodeJSON(rp, out); err != nil {
+			return rp, err
+		}
+	} else {
+		io.Copy(ioutil.Discard, rp.Body)
+	}
+	return rp, nil
+}
+
+// doRaw makes an API request with body of contentType. On success the caller
+// must close the body of the response. Requests wait for the rate limit of
+// the server, and retryable requests are retried after rate limiting and
+// transient errors.
+func (c *Client) doRaw(method string, path string, contentType string, body []byte) (*http.Response, error) {
+	b := &backoff.Backoff{
+		Min:    500 * time.Millisecond,
+		Max:    30 * time.Second,
+		Jitter: true,
+	}
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.wait(c.ctx); err != nil {
+			return nil, err
+		}
+		rp, err := c.send(method, path, contentType, body)
+		if err == nil || attempt >= maxRetries || !retryable(method, path) || !(IsTransient(err) || IsRateLimited(err)) {
+			return rp, err
+		}
+		d := b.Duration()
+		c.limiter.count(&c.limiter.stats.Retries)
+		if err := sleep(c.ctx, d); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// send makes a single API request.
+func (c *Client) send(method string, path string, contentType string, body []byte) (*http.Response, error) {
+	var rbody io.Reader
+	if body != nil {
+		rbody = bytes.NewReader(body)
+	}
+	rq, err := http.NewRequestWithContext(c.ctx, method, c.APIURL+path, rbody)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		rq.Header.Set("Content-Type", contentType)
+	}
+	if c.AuthToken != "" {
+		rq.Header.Set(model.HEADER_AUTH, "Bearer "+c.AuthToken)
+	}
+	rq.Header.Set(model.HEADER_REQUESTED_WITH, model.HEADER_REQUESTED_WITH_XML)
+	c.limiter.count(&c.limiter.stats.Requests)
+	rp, err := c.HttpClient.Do(rq)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return nil, c.ctx.Err()
+		}
+		return nil, &Error{Kind: ErrTransient, Err: err}
+	}
+	c.limiter.update(rp)
+	if rp.StatusCode >= 300 {
+		defer rp.Body.Close()
+		e := httpError(rp)
+		if c.onSessionExpired != nil && c.AuthToken != "" && IsSessionExpired(e) {
+			go c.onSessionExpired(c.AuthToken, e)
+		}
+		return rp, e
+	}
+	return rp, nil
+}
+
+// decodeJSON decodes the JSON body of rp in out.
+func decodeJSON(rp *http.Response, out interface{}) error {
+	if err := json.NewDecoder(rp.Body).Decode(out); err != nil {
+		return errors.New(rp.Request.Method + " " + rp.Request.URL.Path + ": " + err.Error())
+	}
+	return nil
+}
+
+// apiError turns an error response in a *model.AppError.
+func apiError(rp *http.Response) *model.AppError {
+	data, _ := ioutil.ReadAll(rp.Body)
+	appErr := model.AppErrorFromJson(bytes.NewReader(data))
+	if appErr.Message == "" || appErr.Id == "model.utils.decode_json.app_error" {
+		appErr = &model.AppError{Message: rp.Status, DetailedError: strings.TrimSpace(string(data))}
+	}
+	appErr.StatusCode = rp.StatusCode
+	appErr.Where = rp.Request.Method + " " + rp.Request.URL.Path
+	return appErr
+}
+
+// Login logs in with login/password and stores the session token.
+func (c *Client) Login(login string, password string) (*model.User, error) {
+	var user model.User
+	rp, err := c.do("POST", "/users/login", map[string]string{"login_id": login, "password": password}, &user)
+	if err != nil {
+		return nil, err
+	}
+	c.AuthToken = rp.Header.Get(model.HEADER_TOKEN)
+	return &user, nil
+}
+
+// SetToken uses a session or personal access token for authentication.
+func (c *Client) SetToken(token string) {
+	c.AuthToken = token
+}
+
+func (c *Client) Logout() error {
+	_, err := c.do("POST", "/users/logout", nil, nil)
+	c.AuthToken = ""
+	return err
+}
+
+func (c *Client) GetMe() (*model.User, error) {
+	var user model.User
+	_, err := c.do("GET", "/users/me", nil, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (c *Client) GetUser(userId string) (*model.User, error) {
+	var user model.User
+	_, err := c.do("GET", "/users/"+userId, nil, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (c *Client) GetUserByUsername(username string) (*model.User, error) {
+	var user model.User
+	_, err := c.do("GET", "/users/username/"+url.PathEscape(username), nil, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUsers returns all users matching query (e.g. in_team=<id>), fetching all pages.
+func (c *Client) GetUsers(query url.Values, max int) ([]*model.User, error) {
+	var users []*model.User
+	for page := 0; max <= 0 || len(users) < max; page++ {
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(perPage))
+		var result []*model.User
+		if _, err := c.do("GET", "/users?"+query.Encode(), nil, &result); err != nil {
+			return users, err
+		}
+		users = append(users, result...)
+		if len(result) < perPage {
+			break
+		}
+	}
+	return users, nil
+}
+
+// GetClientConfig returns the part of the server configuration visible to clients.
+func (c *Client) GetClientConfig() (map[string]string, error) {
+	var config map[string]string
+	_, err := c.do("GET", "/config/client?format=old", nil, &config)
+	return config, err
+}
+
+func (c *Client) GetTeamsForUser(userId string) ([]*model.Team, error) {
+	var teams []*model.Team
+	_, err := c.do("GET", "/users/"+userId+"/teams", nil, &teams)
+	return teams, err
+}
+
+// GetChannelsForTeamForUser returns the channels (including direct channels) of user in team.
+func (c *Client) GetChannelsForTeamForUser(teamId string, userId string) ([]*model.Channel, error) {
+	var channels []*model.Channel
+	_, err := c.do("GET", "/users/"+userId+"/teams/"+teamId+"/channels", nil, &channels)
+	return channels, err
+}
+
+func (c *Client) GetChannelMembersForUser(userId string, teamId string) ([]*model.ChannelMember, error) {
+	var members []*model.ChannelMember
+	_, err := c.do("GET", "/users/"+userId+"/teams/"+teamId+"/channels/members", nil, &members)
+	return members, err
+}
+
+// GetPublicChannelsForTeam returns all public channels of team, fetching all pages.
+func (c *Client) GetPublicChannelsForTeam(teamId string) ([]*model.Channel, error) {
+	var channels []*model.Channel
+	for page := 0; ; page++ {
+		var result []*model.Channel
+		path := "/teams/" + teamId + "/channels?page=" + strconv.Itoa(page) + "&per_page=" + strconv.Itoa(perPage)
+		if _, err := c.do("GET", path, nil, &result); err != nil {
+			return channels, err
+		}
+		channels = append(channels, result...)
+		if len(result) < perPage {
+			return channels, nil
+		}
+	}
+}
+
+func (c *Client) GetChannel(channelId string) (*model.Channel, error) {
+	var channel model.Channel
+	_, err := c.do("GET", "/channels/"+channelId, nil, &channel)
+	if err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+func (c *Client) CreateChannel(channel *model.Channel) (*model.Channel, error) {
+	var rchannel model.Channel
+	_, err := c.do("POST", "/channels", channel, &rchannel)
+	if err != nil {
+		return nil, err
+	}
+	return &rchannel, nil
+}
+
+func (c *Client) AddChannelMember(channelId string, userId string) error {
+	_, err := c.do("POST", "/channels/"+channelId+"/members", map[string]string{"user_id": userId}, nil)
+	return err
+}
+
+func (c *Client) PatchChannel(channelId string, patch map[string]string) (*model.Channel, error) {
+	var channel model.Channel
+	_, err := c.do("PUT", "/channels/"+channelId+"/patch", patch, &channel)
+	if err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+func (c *Client) ViewChannel(userId string, channelId string) error {
+	_, err := c.do("POST", "/channels/members/"+userId+"/view", map[string]string{"channel_id": channelId}, nil)
+	return err
+}
+
+func (c *Client) CreateDirectChannel(userId1 string, userId2 string) (*model.Channel, error) {
+	var channel model.Channel
+	_, err := c.do("POST", "/channels/direct", []string{userId1, userId2}, &channel)
+	if err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+// CreatePost creates post, a PendingPostId is added (if not set) so retries don't duplicate it.
+func (c *Client) CreatePost(post *model.Post) (*model.Post, error) {
+	var rpost model.Post
+	if post.PendingPostId == "" {
+		p := *post
+		p.PendingPostId = pendingPostId()
+		post = &p
+	}
+	_, err := c.do("POST", "/posts", post, &rpost)
+	if err != nil {
+		return nil, err
+	}
+	return &rpost, nil
+}
+
+func (c *Client) GetPostsSince(channelId string, since int64) (*model.PostList, error) {
+	var list model.PostList
+	_, err := c.do("GET", "/channels/"+channelId+"/posts?since="+strconv.FormatInt(since, 10), nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *Client) GetPostsForChannel(channelId string, page int, perPage int) (*model.PostList, error) {
+	var list model.PostList
+	path := "/channels/" + channelId + "/posts?page=" + strconv.Itoa(page) + "&per_page=" + strconv.Itoa(perPage)
+	_, err := c.do("GET", path, nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *Client) SearchPosts(teamId string, terms string, isOrSearch bool) (*model.PostList, error) {
+	var list model.PostList
+	body := map[string]interface{}{"terms": terms, "is_or_search": isOrSearch}
+	_, err := c.do("POST", "/teams/"+teamId+"/posts/search", body, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *Client) GetFileLink(fileId string) (string, error) {
+	var link map[string]string
+	_, err := c.do("GET", "/files/"+fileId+"/link", nil, &link)
+	return link["link"], err
+}
@@ -0,0 +1,107 @@
+package matterclient
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// ErrorKind classifies errors returned by the API so callers can decide to retry.
+type ErrorKind int
+
+const (
+	ErrUnknown ErrorKind = iota
+	// ErrAuth means our credentials or session are invalid (or we lack permissions).
+	ErrAuth
+	// ErrNotFound means the user, channel, post, ... doesn't exist.
+	ErrNotFound
+	// ErrRateLimited means we're sending too many requests, see Error.RetryAfter.
+	ErrRateLimited
+	// ErrTransient means a network or server error, retrying later may succeed.
+	ErrTransient
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrAuth:
+		return "auth"
+	case ErrNotFound:
+		return "not found"
+	case ErrRateLimited:
+		return "rate limited"
+	case ErrTransient:
+		return "transient"
+	}
+	return "unknown"
+}
+
+// Error is returned by the Client and the error returning MMClient methods.
+type Error struct {
+	Kind       ErrorKind
+	StatusCode int
+	// RetryAfter is set by the server when we're rate limited
+	RetryAfter time.Duration
+	// AppError is the error the server returned, nil for network errors
+	AppError *model.AppError
+	Err      error
+}
+
+func (e *Error) Error() string {
+	if e.AppError != nil {
+		return e.Kind.String() + " error: " + e.AppError.Where + ": " + e.AppError.Message
+	}
+	return e.Kind.String() + " error: " + e.Err.Error()
+}
+
+// httpError classifies the error response rp.
+func httpError(rp *http.Response) *Error {
+	e := &Error{StatusCode: rp.StatusCode, AppError: apiError(rp)}
+	e.Err = e.AppError
+	switch {
+	case rp.StatusCode == http.StatusUnauthorized || rp.StatusCode == http.StatusForbidden:
+		e.Kind = ErrAuth
+	case rp.StatusCode == http.StatusNotFound:
+		e.Kind = ErrNotFound
+	case rp.StatusCode == http.StatusTooManyRequests:
+		e.Kind = ErrRateLimited
+		e.RetryAfter, _ = retryAfter(rp.Header)
+	case rp.StatusCode >= 500:
+		e.Kind = ErrTransient
+	}
+	return e
+}
+
+func errorKind(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return ErrUnknown
+}
+
+// IsAuthError returns true if err is caused by invalid credentials or permissions.
+func IsAuthError(err error) bool {
+	return errorKind(err) == ErrAuth
+}
+
+// IsSessionExpired returns true if err is caused by an expired or revoked session (401).
+// Unlike other auth errors this means we must login again.
+func IsSessionExpired(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Kind == ErrAuth && e.StatusCode == http.StatusUnauthorized
+}
+
+// IsNotFound returns true if err is caused by something that doesn't exist.
+func IsNotFound(err error) bool {
+	return errorKind(err) == ErrNotFound
+}
+
+// IsRateLimited returns true if err is caused by sending too many requests.
+func IsRateLimited(err error) bool {
+	return errorKind(err) == ErrRateLimited
+}
+
+// IsTransient returns true for errors worth retrying: network errors and server side (5xx) errors.
+func IsTransient(err error) bool {
+	return errorKind(err) == ErrTransient
+}
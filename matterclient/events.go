@@ -0,0 +1,188 @@
+package matterclient
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/mattermost/platform/model"
+)
+
+// websocket events of the API v4 not known to our vendored model
+const (
+	ACTION_HELLO            = "hello"
+	ACTION_STATUS_CHANGE    = "status_change"
+	ACTION_REACTION_ADDED   = "reaction_added"
+	ACTION_REACTION_REMOVED = "reaction_removed"
+	ACTION_CHANNEL_CREATED  = "channel_created"
+	ACTION_CHANNEL_UPDATED  = "channel_updated"
+	ACTION_ADDED_TO_TEAM    = "added_to_team"
+	ACTION_LEAVE_TEAM       = "leave_team"
+	ACTION_UPDATE_TEAM      = "update_team"
+	ACTION_USER_UPDATED     = "user_updated"
+)
+
+// Reaction is an emoji reaction on a post.
+type Reaction struct {
+	UserId    string `json:"user_id"`
+	PostId    string `json:"post_id"`
+	EmojiName string `json:"emoji_name"`
+	CreateAt  int64  `json:"create_at"`
+}
+
+// parseMessage fills in the fields of rmsg belonging to its action.
+func (m *MMClient) parseMessage(rmsg *Message) {
+	raw := rmsg.Raw
+	rmsg.UserId = raw.UserId
+	rmsg.ChannelId = raw.ChannelId
+	rmsg.TeamId = raw.TeamId
+	switch raw.Action {
+	case model.ACTION_POSTED, model.ACTION_POST_EDITED, model.ACTION_POST_DELETED:
+		m.parseActionPost(rmsg)
+	case ACTION_REACTION_ADDED, ACTION_REACTION_REMOVED:
+		m.parseActionReaction(rmsg)
+	case model.ACTION_TYPING:
+		rmsg.ParentId = raw.Props["parent_id"]
+	case ACTION_STATUS_CHANGE:
+		rmsg.Status = raw.Props["status"]
+	case ACTION_CHANNEL_CREATED, ACTION_CHANNEL_UPDATED, model.ACTION_CHANNEL_DELETED:
+		m.parseActionChannel(rmsg)
+	case model.ACTION_USER_ADDED, model.ACTION_USER_REMOVED:
+		m.parseActionUser(rmsg)
+	case ACTION_USER_UPDATED:
+		if user := model.UserFromJson(strings.NewReader(raw.Props["user"])); user != nil {
+			m.setUser(user)
+			rmsg.UserId = user.Id
+		}
+	case ACTION_ADDED_TO_TEAM, ACTION_LEAVE_TEAM, ACTION_UPDATE_TEAM:
+		m.parseActionTeam(rmsg)
+	case ACTION_HELLO:
+		rmsg.ServerVersion = raw.Props["server_version"]
+	}
+	// only posts are worth a request, for other events we use what we know
+	if rmsg.Username == "" && rmsg.UserId != "" {
+		if user := m.GetUser(rmsg.UserId); user != nil {
+			rmsg.Username = user.Username
+		}
+	}
+	if rmsg.Channel == "" && rmsg.ChannelId != "" {
+		rmsg.Channel = m.GetChannelName(rmsg.ChannelId)
+	}
+	if rmsg.TeamId != "" {
+		rmsg.Team = m.GetTeamName(rmsg.TeamId)
+	}
+}
+
+func (m *MMClient) parseActionPost(rmsg *Message) {
+	data := model.PostFromJson(strings.NewReader(rmsg.Raw.Props["post"]))
+	if data == nil {
+		m.log.Errorf("invalid post in %s event: %#v", rmsg.Raw.Action, rmsg.Raw.Props["post"])
+		return
+	}
+	rmsg.UserId = data.UserId
+	rmsg.ChannelId = data.ChannelId
+	// e.g. a new direct message channel
+	if !m.isMember(data.ChannelId) {
+		m.fetchChannel(context.Background(), data.ChannelId, true)
+	}
+	if rmsg.Raw.Action == model.ACTION_POSTED {
+		rmsg.Username = m.username(data.UserId)
+	} else if user := m.GetUser(data.UserId); user != nil {
+		rmsg.Username = user.Username
+	}
+	rmsg.Channel = m.GetChannelName(data.ChannelId)
+	rmsg.ChannelType = rmsg.Raw.Props["channel_type"]
+	if rmsg.ChannelType == "" {
+		if channel := m.getChannel(data.ChannelId); channel != nil {
+			rmsg.ChannelType = channel.Type
+		}
+	}
+	// direct message
+	if rmsg.ChannelType == model.CHANNEL_DIRECT {
+		rmsg.Channel = rmsg.Username
+		rmsg.Direct = true
+	}
+	rmsg.Text = data.Message
+	rmsg.Post = data
+	// our model.Post predates file ids
+	var files struct {
+		FileIds []string `json:"file_ids"`
+	}
+	json.Unmarshal([]byte(rmsg.Raw.Props["post"]), &files)
+	rmsg.FileIds = files.FileIds
+}
+
+func (m *MMClient) parseActionReaction(rmsg *Message) {
+	var reaction Reaction
+	if err := json.Unmarshal([]byte(rmsg.Raw.Props["reaction"]), &reaction); err != nil {
+		m.log.Errorf("invalid reaction in %s event: %s", rmsg.Raw.Action, err)
+		return
+	}
+	rmsg.Reaction = &reaction
+	rmsg.UserId = reaction.UserId
+	rmsg.Text = reaction.EmojiName
+}
+
+func (m *MMClient) parseActionChannel(rmsg *Message) {
+	if data, ok := rmsg.Raw.Props["channel"]; ok {
+		rmsg.ChannelInfo = model.ChannelFromJson(strings.NewReader(data))
+		if rmsg.ChannelInfo != nil {
+			rmsg.ChannelId = rmsg.ChannelInfo.Id
+			rmsg.Channel = rmsg.ChannelInfo.Name
+			if rmsg.TeamId == "" {
+				rmsg.TeamId = rmsg.ChannelInfo.TeamId
+			}
+		}
+	}
+	switch rmsg.Raw.Action {
+	case ACTION_CHANNEL_CREATED:
+		// only sent to the creator, who is a member
+		m.fetchChannel(context.Background(), rmsg.ChannelId, true)
+	case ACTION_CHANNEL_UPDATED:
+		if rmsg.ChannelInfo != nil {
+			m.setChannel(rmsg.ChannelId, rmsg.ChannelInfo, m.isMember(rmsg.ChannelId))
+		}
+	case model.ACTION_CHANNEL_DELETED:
+		if rmsg.Channel == "" {
+			rmsg.Channel = m.GetChannelName(rmsg.ChannelId)
+		}
+		m.setChannel(rmsg.ChannelId, nil, false)
+	}
+}
+
+func (m *MMClient) parseActionUser(rmsg *Message) {
+	if rmsg.UserId != m.userId() {
+		return
+	}
+	switch rmsg.Raw.Action {
+	case model.ACTION_USER_ADDED:
+		m.fetchChannel(context.Background(), rmsg.ChannelId, true)
+	case model.ACTION_USER_REMOVED:
+		rmsg.Channel = m.GetChannelName(rmsg.ChannelId)
+		m.RLock()
+		var channel *model.Channel
+		if e, ok := m.channelsById[rmsg.ChannelId]; ok {
+			channel = e.channel
+		}
+		m.RUnlock()
+		// public channels we left can still be joined
+		m.setChannel(rmsg.ChannelId, channel, false)
+	}
+}
+
+func (m *MMClient) parseActionTeam(rmsg *Message) {
+	if data, ok := rmsg.Raw.Props["team"]; ok {
+		rmsg.TeamInfo = model.TeamFromJson(strings.NewReader(data))
+		if rmsg.TeamInfo != nil {
+			rmsg.TeamId = rmsg.TeamInfo.Id
+		}
+	}
+}
+
+// username returns the username of userId, fetching the user if we don't know it.
+func (m *MMClient) username(userId string) string {
+	if user := m.fetchUser(context.Background(), userId); user != nil {
+		return user.Username
+	}
+	return ""
+}
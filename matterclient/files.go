@@ -0,0 +1,122 @@
+package matterclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+
+	"github.com/mattermost/platform/model"
+)
+
+// FileInfo describes an uploaded file (API v4).
+type FileInfo struct {
+	Id              string `json:"id"`
+	UserId          string `json:"user_id"`
+	PostId          string `json:"post_id"`
+	CreateAt        int64  `json:"create_at"`
+	Name            string `json:"name"`
+	Extension       string `json:"extension"`
+	Size            int64  `json:"size"`
+	MimeType        string `json:"mime_type"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	HasPreviewImage bool   `json:"has_preview_image"`
+}
+
+// postWithFiles is a post with attachments, our model.Post predates file ids.
+type postWithFiles struct {
+	*model.Post
+	FileIds []string `json:"file_ids"`
+}
+
+// UploadFile uploads data as filename to channelId, it has to be attached to a post afterwards.
+func (c *Client) UploadFile(channelId string, filename string, data io.Reader) (*FileInfo, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	if err := w.WriteField("channel_id", channelId); err != nil {
+		return nil, err
+	}
+	part, err := w.CreateFormFile("files", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	rp, err := c.doRaw("POST", "/files", w.FormDataContentType(), body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer rp.Body.Close()
+	var result struct {
+		FileInfos []*FileInfo `json:"file_infos"`
+	}
+	if err := decodeJSON(rp, &result); err != nil {
+		return nil, err
+	}
+	if len(result.FileInfos) == 0 {
+		return nil, &Error{Kind: ErrUnknown, Err: io.ErrUnexpectedEOF}
+	}
+	return result.FileInfos[0], nil
+}
+
+// GetFile returns the content of fileId.
+func (c *Client) GetFile(fileId string) ([]byte, error) {
+	rp, err := c.doRaw("GET", "/files/"+fileId, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rp.Body.Close()
+	return ioutil.ReadAll(rp.Body)
+}
+
+func (c *Client) GetFileInfo(fileId string) (*FileInfo, error) {
+	var info FileInfo
+	_, err := c.do("GET", "/files/"+fileId+"/info", nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// CreatePostWithFiles creates post with the uploaded files fileIds attached.
+func (c *Client) CreatePostWithFiles(post *model.Post, fileIds []string) (*model.Post, error) {
+	var rpost model.Post
+	if post.PendingPostId == "" {
+		p := *post
+		p.PendingPostId = pendingPostId()
+		post = &p
+	}
+	_, err := c.do("POST", "/posts", &postWithFiles{Post: post, FileIds: fileIds}, &rpost)
+	if err != nil {
+		return nil, err
+	}
+	return &rpost, nil
+}
+
+// UploadFileContext uploads data as filename to channelId. Attach it to a post
+// with PostFilesContext.
+func (m *MMClient) UploadFileContext(ctx context.Context, channelId string, filename string, data []byte) (*FileInfo, error) {
+	return m.client(ctx).UploadFile(channelId, filename, bytes.NewReader(data))
+}
+
+// PostFilesContext posts text with the uploaded files fileIds attached to channelId.
+func (m *MMClient) PostFilesContext(ctx context.Context, channelId string, text string, fileIds []string) (*model.Post, error) {
+	post := &model.Post{ChannelId: channelId, Message: text}
+	return m.client(ctx).CreatePostWithFiles(post, fileIds)
+}
+
+// GetFileContext downloads the file fileId.
+func (m *MMClient) GetFileContext(ctx context.Context, fileId string) ([]byte, error) {
+	return m.client(ctx).GetFile(fileId)
+}
+
+// GetFileInfoContext returns the name, size, type, ... of the file fileId.
+func (m *MMClient) GetFileInfoContext(ctx context.Context, fileId string) (*FileInfo, error) {
+	return m.client(ctx).GetFileInfo(fileId)
+}
@@ -0,0 +1,75 @@
+package matterclient
+
+import (
+	"github.com/mattermost/platform/model"
+)
+
+// how many events a handler can lag behind before it blocks the websocket receiver
+const handlerQueueSize = 100
+
+// HandlerFunc handles a websocket event. msg is shared with other handlers, do not modify it.
+type HandlerFunc func(msg *Message)
+
+// handler runs its HandlerFunc in its own goroutine, events are handled in order.
+type handler struct {
+	fn    HandlerFunc
+	queue chan *Message
+}
+
+func newHandler(fn HandlerFunc) *handler {
+	h := &handler{fn: fn, queue: make(chan *Message, handlerQueueSize)}
+	go func() {
+		for msg := range h.queue {
+			h.fn(msg)
+		}
+	}()
+	return h
+}
+
+// On registers fn for events with action (e.g. model.ACTION_POSTED), "" registers
+// fn for all events. Each handler runs in its own goroutine and gets the events
+// in the order they were received.
+// MessageChan is still filled, set it to nil if you don't read from it.
+func (m *MMClient) On(action string, fn HandlerFunc) {
+	m.handlersMu.Lock()
+	defer m.handlersMu.Unlock()
+	m.handlers[action] = append(m.handlers[action], newHandler(fn))
+}
+
+// OnPost registers fn for new posts.
+func (m *MMClient) OnPost(fn HandlerFunc) {
+	m.On(model.ACTION_POSTED, fn)
+}
+
+// OnEdit registers fn for edited posts.
+func (m *MMClient) OnEdit(fn HandlerFunc) {
+	m.On(model.ACTION_POST_EDITED, fn)
+}
+
+// OnReaction registers fn for added and removed reactions, see Message.Raw.Action.
+func (m *MMClient) OnReaction(fn HandlerFunc) {
+	h := newHandler(fn)
+	m.handlersMu.Lock()
+	defer m.handlersMu.Unlock()
+	// the same handler for both, so the order of add/remove is kept
+	m.handlers[ACTION_REACTION_ADDED] = append(m.handlers[ACTION_REACTION_ADDED], h)
+	m.handlers[ACTION_REACTION_REMOVED] = append(m.handlers[ACTION_REACTION_REMOVED], h)
+}
+
+// OnUserAdded registers fn for users added to a channel.
+func (m *MMClient) OnUserAdded(fn HandlerFunc) {
+	m.On(model.ACTION_USER_ADDED, fn)
+}
+
+// dispatch queues msg for the handlers of its action. Queueing blocks when a
+// handler lags behind, so it's done without holding handlersMu: handlers may
+// register other handlers.
+func (m *MMClient) dispatch(msg *Message) {
+	m.handlersMu.RLock()
+	handlers := append([]*handler{}, m.handlers[msg.Raw.Action]...)
+	handlers = append(handlers, m.handlers[""]...)
+	m.handlersMu.RUnlock()
+	for _, h := range handlers {
+		h.queue <- msg
+	}
+}
@@ -0,0 +1,75 @@
+package matterclient
+
+import (
+	"container/list"
+	"sync"
+)
+
+// users kept in lazy mode when UserCacheSize isn't set
+const defaultUserCacheSize = 1000
+
+// lru keeps track of the least recently used keys of a cache.
+type lru struct {
+	sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRU(size int) *lru {
+	if size <= 0 {
+		size = defaultUserCacheSize
+	}
+	return &lru{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// touch marks key as recently used.
+func (l *lru) touch(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+// add adds key and returns the key that must be evicted from the cache, if any.
+func (l *lru) add(key string) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return "", false
+	}
+	l.items[key] = l.order.PushFront(key)
+	if l.order.Len() <= l.size {
+		return "", false
+	}
+	oldest := l.order.Back()
+	l.order.Remove(oldest)
+	evicted := oldest.Value.(string)
+	delete(l.items, evicted)
+	return evicted, true
+}
+
+// seen returns true if key is known, otherwise it's added (evicting the oldest key).
+func (l *lru) seen(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return true
+	}
+	l.items[key] = l.order.PushFront(key)
+	if l.order.Len() > l.size {
+		delete(l.items, l.order.Remove(l.order.Back()).(string))
+	}
+	return false
+}
+
+// reset forgets all keys.
+func (l *lru) reset() {
+	l.Lock()
+	defer l.Unlock()
+	l.order.Init()
+	l.items = make(map[string]*list.Element)
+}
@@ -0,0 +1,75 @@
+package matterclient
+
+import "testing"
+
+func TestLRUAdd(t *testing.T) {
+	type step struct {
+		op      string // add, touch or reset
+		key     string
+		evicted string // for add, "" if nothing is evicted
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"evict oldest", []step{
+			{"add", "a", ""}, {"add", "b", ""}, {"add", "c", "a"}, {"add", "d", "b"},
+		}},
+		{"touch keeps a key", []step{
+			{"add", "a", ""}, {"add", "b", ""}, {"touch", "a", ""}, {"add", "c", "b"},
+		}},
+		{"touch of an unknown key", []step{
+			{"add", "a", ""}, {"touch", "x", ""}, {"add", "b", ""}, {"add", "c", "a"},
+		}},
+		{"adding again is a touch", []step{
+			{"add", "a", ""}, {"add", "b", ""}, {"add", "a", ""}, {"add", "c", "b"},
+		}},
+		{"reset", []step{
+			{"add", "a", ""}, {"add", "b", ""}, {"reset", "", ""}, {"add", "c", ""}, {"add", "d", ""}, {"add", "e", "c"},
+		}},
+	}
+	for _, tt := range tests {
+		l := newLRU(2)
+		for i, s := range tt.steps {
+			switch s.op {
+			case "add":
+				evicted, ok := l.add(s.key)
+				if evicted != s.evicted || ok != (s.evicted != "") {
+					t.Errorf("%s: step %d: add(%s) = %q, %v, want %q", tt.name, i, s.key, evicted, ok, s.evicted)
+				}
+			case "touch":
+				l.touch(s.key)
+			case "reset":
+				l.reset()
+			}
+		}
+	}
+}
+
+func TestLRUSeen(t *testing.T) {
+	tests := []struct {
+		keys []string
+		want []bool
+	}{
+		{[]string{"a", "b", "a", "b"}, []bool{false, false, true, true}},
+		// c evicts a, then a evicts b
+		{[]string{"a", "b", "b", "c", "a", "b"}, []bool{false, false, true, false, false, false}},
+		{[]string{"a", "b", "a", "c", "a", "b"}, []bool{false, false, true, false, true, false}},
+	}
+	for _, tt := range tests {
+		l := newLRU(2)
+		for i, key := range tt.keys {
+			if got := l.seen(key); got != tt.want[i] {
+				t.Errorf("%v: seen(%s) at %d = %v, want %v", tt.keys, key, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestNewLRUDefaultSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		if l := newLRU(size); l.size != defaultUserCacheSize {
+			t.Errorf("newLRU(%d).size = %d, want %d", size, l.size, defaultUserCacheSize)
+		}
+	}
+}
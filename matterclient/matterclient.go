@@ -1,11 +1,13 @@
 package matterclient
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,13 +19,28 @@ import (
 	"github.com/mattermost/platform/model"
 )
 
+const (
+	wsPingInterval = 30 * time.Second
+	// no data (or pong) for this long means the connection is dead
+	wsReadTimeout  = 3 * wsPingInterval
+	wsWriteTimeout = 10 * time.Second
+	// posts remembered to skip duplicates after a resync
+	recentPostsSize = 1000
+)
+
 type Credentials struct {
-	Login         string
-	Team          string
-	Pass          string
+	Login string
+	Team  string
+	Pass  string
+	// Token is a personal access token (or bot token), used instead of Login/Pass.
+	Token         string
 	Server        string
 	NoTLS         bool
 	SkipTLSVerify bool
+	// LazyLoad only loads the channels of our team at login, other teams and
+	// users are fetched when needed. At most UserCacheSize users are kept.
+	LazyLoad      bool
+	UserCacheSize int
 }
 
 type Message struct {
@@ -33,6 +50,21 @@ type Message struct {
 	Channel  string
 	Username string
 	Text     string
+	Direct   bool
+	// type of Channel (model.CHANNEL_*)
+	ChannelType string
+	// filled in depending on Raw.Action, see parseMessage
+	UserId        string
+	ChannelId     string
+	TeamId        string
+	Reaction      *Reaction
+	ChannelInfo   *model.Channel
+	TeamInfo      *model.Team
+	Status        string
+	ParentId      string
+	ServerVersion string
+	// attachments of Post
+	FileIds []string
 }
 
 type Team struct {
@@ -41,32 +73,72 @@ type Team struct {
 	Channels     *model.ChannelList
 	MoreChannels *model.ChannelList
 	Users        map[string]*model.User
+	// false for teams we didn't fetch the channels of yet (LazyLoad)
+	loaded bool
 }
 
+// MMClient is a Mattermost client for bots and bridges.
+//
+// The embedded RWMutex guards Client, User, Users, Team, OtherTeams and the
+// indexes built from them. Teams and their channel lists are replaced, never
+// modified in place, so callers can keep using what they got.
+// wsMu guards the websocket state (WsClient, WsQuit, WsAway, WsConnected).
+// The exported fields are kept for compatibility, read them through the
+// Get* and Connected methods while the client is in use.
 type MMClient struct {
 	sync.RWMutex
 	*Credentials
 	Team        *Team
 	OtherTeams  []*Team
-	Client      *model.Client
+	Client      *Client
 	WsClient    *websocket.Conn
 	WsQuit      bool
 	WsAway      bool
 	WsConnected bool
+	wsMu        sync.Mutex
 	User        *model.User
 	Users       map[string]*model.User
+	// MessageChan receives all events, set it to nil when only using handlers (see On)
 	MessageChan chan *Message
 	log         *log.Entry
+	handlersMu  sync.RWMutex
+	// channel id -> channel, "teamid/name" -> channel id, lowercase username -> user id
+	channelsById map[string]*channelEntry
+	channelIds   map[string]string
+	// "teamid/lowercase display name" -> channel id
+	channelDisplayIds map[string]string
+	usernames         map[string]string
+	wsURL             string
+	// server configuration for clients, see GetClientConfig
+	clientConfig map[string]string
+	// recently used users, only in LazyLoad mode
+	userCache *lru
+	// CreateAt of the newest post we received, used to resync after reconnects
+	lastPostAt int64
+	// ids of the posts we handled last
+	recentPosts  *lru
+	handlers     map[string][]*handler
+	authHandlers []AuthStateFunc
+	// serializes re-authentication and websocket reconnects
+	reauthMu sync.Mutex
 }
 
 func New(login, pass, team, server string) *MMClient {
 	cred := &Credentials{Login: login, Pass: pass, Team: team, Server: server}
-	mmclient := &MMClient{Credentials: cred, MessageChan: make(chan *Message, 100), Users: make(map[string]*model.User)}
+	mmclient := &MMClient{Credentials: cred, MessageChan: make(chan *Message, 100), Users: make(map[string]*model.User),
+		handlers: make(map[string][]*handler), recentPosts: newLRU(recentPostsSize)}
 	mmclient.log = log.WithFields(log.Fields{"module": "matterclient"})
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
 	return mmclient
 }
 
+// NewWithToken returns a client authenticating with a personal access token or bot token.
+func NewWithToken(token, team, server string) *MMClient {
+	mmclient := New("", "", team, server)
+	mmclient.Credentials.Token = token
+	return mmclient
+}
+
 func (m *MMClient) SetLogLevel(level string) {
 	l, err := log.ParseLevel(level)
 	if err != nil {
@@ -77,8 +149,8 @@ func (m *MMClient) SetLogLevel(level string) {
 }
 
 func (m *MMClient) Login() error {
-	m.WsConnected = false
-	if m.WsQuit {
+	m.setConnected(false)
+	if m.quitting() {
 		return nil
 	}
 	b := &backoff.Backoff{
@@ -93,43 +165,36 @@ func (m *MMClient) Login() error {
 		wsScheme = "ws://"
 	}
 	// login to mattermost
-	m.Client = model.NewClient(uriScheme + m.Credentials.Server)
-	m.Client.HttpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: m.SkipTLSVerify}}
-	var myinfo *model.Result
-	var appErr *model.AppError
+	client := NewClient(uriScheme + m.Credentials.Server)
+	client.HttpClient.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{InsecureSkipVerify: m.SkipTLSVerify}}
+	var user *model.User
+	var err error
 	var logmsg = "trying login"
+	token := m.Credentials.Token
+	// MMAUTHTOKEN=yourtoken in the password is still accepted for SSO users
+	if token == "" && strings.Contains(m.Credentials.Pass, model.SESSION_COOKIE_TOKEN) {
+		t := strings.Split(m.Credentials.Pass, model.SESSION_COOKIE_TOKEN+"=")
+		if len(t) != 2 {
+			return errors.New("incorrect MMAUTHTOKEN. valid input is MMAUTHTOKEN=yourtoken")
+		}
+		token = t[1]
+	}
 	for {
 		m.log.Debugf("%s %s %s %s", logmsg, m.Credentials.Team, m.Credentials.Login, m.Credentials.Server)
-		if strings.Contains(m.Credentials.Pass, model.SESSION_COOKIE_TOKEN) {
-			m.log.Debugf(logmsg+" with %s", model.SESSION_COOKIE_TOKEN)
-			token := strings.Split(m.Credentials.Pass, model.SESSION_COOKIE_TOKEN+"=")
-			if len(token) != 2 {
-				return errors.New("incorrect MMAUTHTOKEN. valid input is MMAUTHTOKEN=yourtoken")
-			}
-			m.Client.HttpClient.Jar = m.createCookieJar(token[1])
-			m.Client.MockSession(token[1])
-			myinfo, appErr = m.Client.GetMe("")
-			if appErr != nil {
-				return errors.New(appErr.DetailedError)
-			}
-			if myinfo.Data.(*model.User) == nil {
-				m.log.Errorf("LOGIN TOKEN: %s is invalid", m.Credentials.Pass)
-				return errors.New("invalid " + model.SESSION_COOKIE_TOKEN)
-			}
+		if token != "" {
+			m.log.Debug(logmsg + " with token")
+			client.SetToken(token)
+			user, err = client.GetMe()
 		} else {
-			myinfo, appErr = m.Client.Login(m.Credentials.Login, m.Credentials.Pass)
+			user, err = client.Login(m.Credentials.Login, m.Credentials.Pass)
 		}
-		if appErr != nil {
+		if err != nil {
 			d := b.Duration()
-			m.log.Debug(appErr.DetailedError)
-			if !strings.Contains(appErr.DetailedError, "connection refused") &&
-				!strings.Contains(appErr.DetailedError, "invalid character") {
-				if appErr.Message == "" {
-					return errors.New(appErr.DetailedError)
-				}
-				return errors.New(appErr.Message)
+			m.log.Debug(err)
+			if !IsTransient(err) {
+				return err
 			}
-			m.log.Debugf("LOGIN: %s, reconnecting in %s", appErr, d)
+			m.log.Debugf("LOGIN: %s, reconnecting in %s", err, d)
 			time.Sleep(d)
 			logmsg = "retrying login"
 			continue
@@ -139,26 +204,105 @@ func (m *MMClient) Login() error {
 	// reset timer
 	b.Reset()
 
-	err := m.initUser()
+	err = m.initUser(client, user)
+	if err != nil {
+		return err
+	}
+
+	// setup websocket connection
+	err = m.wsConnect(wsScheme+m.Credentials.Server+apiURLSuffix+"/websocket", client.AuthToken)
 	if err != nil {
 		return err
 	}
+	m.wsMu.Lock()
+	if m.lastPostAt == 0 {
+		m.lastPostAt = model.GetMillis()
+	}
+	m.wsMu.Unlock()
+
+	// only start to parse WS messages when login is completely done
+	m.setConnected(true)
+
+	return nil
+}
+
+// Connected returns true when we're logged in and receiving websocket events.
+func (m *MMClient) Connected() bool {
+	m.wsMu.Lock()
+	defer m.wsMu.Unlock()
+	return m.WsConnected
+}
+
+func (m *MMClient) setConnected(connected bool) {
+	m.wsMu.Lock()
+	m.WsConnected = connected
+	m.wsMu.Unlock()
+}
+
+// quitting returns true after Logout.
+func (m *MMClient) quitting() bool {
+	m.wsMu.Lock()
+	defer m.wsMu.Unlock()
+	return m.WsQuit
+}
+
+// wsConn returns the current websocket connection, nil after Logout.
+func (m *MMClient) wsConn() *websocket.Conn {
+	m.wsMu.Lock()
+	defer m.wsMu.Unlock()
+	return m.WsClient
+}
+
+// client returns the API client making its requests with ctx.
+func (m *MMClient) client(ctx context.Context) *Client {
+	m.RLock()
+	defer m.RUnlock()
+	return m.Client.WithContext(ctx)
+}
 
-	// set our team id as default route
-	m.Client.SetTeamId(m.Team.Id)
+// userId returns the id of the user we're logged in as.
+func (m *MMClient) userId() string {
+	m.RLock()
+	defer m.RUnlock()
+	return m.User.Id
+}
+
+// teamId returns the id of our (primary) team.
+func (m *MMClient) teamId() (string, error) {
+	m.RLock()
+	defer m.RUnlock()
 	if m.Team == nil {
-		return errors.New("team not found")
+		return "", errors.New("team " + m.Credentials.Team + " not found")
 	}
+	return m.Team.Id, nil
+}
 
-	// setup websocket connection
-	wsurl := wsScheme + m.Credentials.Server + "/api/v3/users/websocket"
+// wsConnect (re)connects the websocket with our session token, retrying until it
+// succeeds or the server rejects token.
+func (m *MMClient) wsConnect(wsURL string, token string) error {
+	b := &backoff.Backoff{
+		Min:    time.Second,
+		Max:    5 * time.Minute,
+		Jitter: true,
+	}
 	header := http.Header{}
-	header.Set(model.HEADER_AUTH, "BEARER "+m.Client.AuthToken)
+	header.Set(model.HEADER_AUTH, "Bearer "+token)
 
 	m.log.Debug("WsClient: making connection")
+	var conn *websocket.Conn
 	for {
+		if m.quitting() {
+			return nil
+		}
 		wsDialer := &websocket.Dialer{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{InsecureSkipVerify: m.SkipTLSVerify}}
-		m.WsClient, _, err = wsDialer.Dial(wsurl, header)
+		var rp *http.Response
+		var err error
+		conn, rp, err = wsDialer.Dial(wsURL, header)
+		if rp != nil && rp.StatusCode == http.StatusUnauthorized {
+			e := httpError(rp)
+			rp.Body.Close()
+			return e
+		}
 		if err != nil {
 			d := b.Duration()
 			m.log.Debugf("WSS: %s, reconnecting in %s", err, d)
@@ -167,137 +311,358 @@ func (m *MMClient) Login() error {
 		}
 		break
 	}
-	b.Reset()
+	// anything from the server (including pongs) proves the connection is alive
+	conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	})
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(wsWriteTimeout))
+	})
+	m.wsMu.Lock()
+	m.wsURL = wsURL
+	m.WsClient = conn
+	m.wsMu.Unlock()
+	go m.wsPinger(conn)
+	return nil
+}
 
-	// only start to parse WS messages when login is completely done
-	m.WsConnected = true
+// wsPinger pings the server over conn so we notice dead connections, until conn fails.
+func (m *MMClient) wsPinger(conn *websocket.Conn) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if m.quitting() {
+			return
+		}
+		if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+			m.log.Debugf("Ws ping failed: %s", err)
+			return
+		}
+	}
+}
 
-	return nil
+// wsReconnect replaces the broken websocket connection conn. The session is
+// reused when it's still valid, otherwise we login again (see reauthenticate).
+// Posts we missed in the meantime are fetched and handled as if they came
+// from the websocket.
+func (m *MMClient) wsReconnect(conn *websocket.Conn) {
+	conn.Close()
+	m.reauthMu.Lock()
+	defer m.reauthMu.Unlock()
+	// already replaced after a re-login
+	if m.wsConn() != conn || m.quitting() {
+		return
+	}
+	client := m.client(context.Background())
+	_, err := client.GetMe()
+	if !IsSessionExpired(err) {
+		m.wsMu.Lock()
+		wsURL := m.wsURL
+		m.wsMu.Unlock()
+		err = m.wsConnect(wsURL, client.AuthToken)
+	}
+	if IsSessionExpired(err) {
+		if m.reauthenticate(err) != nil {
+			return
+		}
+	}
+	m.resync()
+}
+
+// resync handles the posts in our channels created after the last post we received.
+func (m *MMClient) resync() {
+	m.wsMu.Lock()
+	since := m.lastPostAt
+	m.wsMu.Unlock()
+	teamId, err := m.teamId()
+	if since == 0 || err != nil {
+		return
+	}
+	client := m.client(context.Background())
+	var posts []*model.Post
+	for _, channel := range m.GetChannels() {
+		list, err := client.GetPostsSince(channel.Id, since)
+		if err != nil {
+			m.log.Errorf("resync of %s failed: %s", channel.Name, err)
+			continue
+		}
+		for _, post := range list.Posts {
+			// GetPostsSince also returns edited posts, posts we already
+			// handled (also at since) are skipped by handleMessage
+			if post.CreateAt >= since && post.DeleteAt == 0 {
+				posts = append(posts, post)
+			}
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].CreateAt < posts[j].CreateAt })
+	if len(posts) > 0 {
+		m.log.Infof("resyncing %d missed posts", len(posts))
+	}
+	for _, post := range posts {
+		rmsg := model.NewMessage(teamId, post.ChannelId, post.UserId, model.ACTION_POSTED)
+		rmsg.Add("post", post.ToJson())
+		if channel := m.getChannel(post.ChannelId); channel != nil {
+			rmsg.Add("channel_type", channel.Type)
+			rmsg.TeamId = channel.TeamId
+		}
+		m.handleMessage(rmsg)
+	}
 }
 
 func (m *MMClient) Logout() error {
 	m.log.Debugf("logout as %s (team: %s) on %s", m.Credentials.Login, m.Credentials.Team, m.Credentials.Server)
-	m.WsQuit = true
-	m.WsClient.Close()
-	m.WsClient.UnderlyingConn().Close()
-	m.WsClient = nil
-	_, err := m.Client.Logout()
-	if err != nil {
-		return err
+	m.stop()
+	// personal access tokens stay valid, only end real sessions
+	if m.Credentials.Token != "" {
+		return nil
 	}
-	return nil
+	return m.client(context.Background()).Logout()
 }
 
 func (m *MMClient) WsReceiver() {
-	var rmsg model.Message
 	for {
-		if m.WsQuit {
+		var event wsEvent
+		conn := m.wsConn()
+		if m.quitting() || conn == nil {
 			m.log.Debug("exiting WsReceiver")
 			return
 		}
-		if err := m.WsClient.ReadJSON(&rmsg); err != nil {
+		if err := conn.ReadJSON(&event); err != nil {
+			if m.quitting() {
+				continue
+			}
 			m.log.Error("error:", err)
-			// reconnect
-			m.Login()
+			m.wsReconnect(conn)
+			continue
 		}
+		conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
 		// we're not fully logged in yet.
-		if !m.WsConnected {
+		if !m.Connected() {
+			continue
+		}
+		// reply to an action we sent
+		if event.Event == "" {
 			continue
 		}
+		rmsg := event.toMessage()
 		if rmsg.Action == "ping" {
 			m.handleWsPing()
 			continue
 		}
-		msg := &Message{Raw: &rmsg, Team: m.Credentials.Team}
-		m.parseMessage(msg)
+		m.handleMessage(rmsg)
+	}
+
+}
+
+// handleMessage parses rmsg and passes it to the handlers and MessageChan.
+func (m *MMClient) handleMessage(rmsg *model.Message) {
+	msg := &Message{Raw: rmsg, Team: m.Credentials.Team}
+	m.parseMessage(msg)
+	if msg.Raw.Action == model.ACTION_POSTED && msg.Post != nil {
+		// resync can overlap with the websocket
+		if m.recentPosts.seen(msg.Post.Id) {
+			m.log.Debugf("skipping already handled post %s", msg.Post.Id)
+			return
+		}
+		m.wsMu.Lock()
+		if msg.Post.CreateAt > m.lastPostAt {
+			m.lastPostAt = msg.Post.CreateAt
+		}
+		m.wsMu.Unlock()
+	}
+	m.dispatch(msg)
+	if m.MessageChan != nil {
 		m.MessageChan <- msg
 	}
+}
 
+// wsEvent is an event received on the API v4 websocket.
+type wsEvent struct {
+	Event     string                 `json:"event"`
+	Data      map[string]interface{} `json:"data"`
+	Broadcast struct {
+		UserId    string `json:"user_id"`
+		ChannelId string `json:"channel_id"`
+		TeamId    string `json:"team_id"`
+	} `json:"broadcast"`
+	Seq int64 `json:"seq"`
+}
+
+// toMessage converts the event to the model.Message we pass to our users.
+// Data values that aren't strings are JSON encoded in Props.
+func (e *wsEvent) toMessage() *model.Message {
+	msg := model.NewMessage(e.Broadcast.TeamId, e.Broadcast.ChannelId, e.Broadcast.UserId, e.Event)
+	for k, v := range e.Data {
+		if str, ok := v.(string); ok {
+			msg.Add(k, str)
+			continue
+		}
+		data, _ := json.Marshal(v)
+		msg.Add(k, string(data))
+	}
+	if msg.TeamId == "" {
+		msg.TeamId = msg.Props["team_id"]
+	}
+	if msg.ChannelId == "" {
+		msg.ChannelId = msg.Props["channel_id"]
+	}
+	if msg.UserId == "" {
+		msg.UserId = msg.Props["user_id"]
+	}
+	return msg
 }
 
 func (m *MMClient) handleWsPing() {
 	m.log.Debug("Ws PING")
-	if !m.WsQuit && !m.WsAway {
+	m.wsMu.Lock()
+	defer m.wsMu.Unlock()
+	if !m.WsQuit && !m.WsAway && m.WsClient != nil {
 		m.log.Debug("Ws PONG")
-		m.WsClient.WriteMessage(websocket.PongMessage, []byte{})
+		m.WsClient.WriteControl(websocket.PongMessage, []byte{}, time.Now().Add(wsWriteTimeout))
 	}
 }
 
-func (m *MMClient) parseMessage(rmsg *Message) {
-	switch rmsg.Raw.Action {
-	case model.ACTION_POSTED:
-		m.parseActionPost(rmsg)
-		/*
-			case model.ACTION_USER_REMOVED:
-				m.handleWsActionUserRemoved(&rmsg)
-			case model.ACTION_USER_ADDED:
-				m.handleWsActionUserAdded(&rmsg)
-		*/
-	}
+func (m *MMClient) UpdateUsers() error {
+	return m.UpdateUsersContext(context.Background())
 }
 
-func (m *MMClient) parseActionPost(rmsg *Message) {
-	data := model.PostFromJson(strings.NewReader(rmsg.Raw.Props["post"]))
-	// we don't have the user, refresh the userlist
-	if m.GetUser(data.UserId) == nil {
-		m.UpdateUsers()
+// UpdateUsersContext refreshes the users of our team.
+func (m *MMClient) UpdateUsersContext(ctx context.Context) error {
+	teamId, err := m.teamId()
+	if err != nil {
+		return err
 	}
-	rmsg.Username = m.GetUser(data.UserId).Username
-	rmsg.Channel = m.GetChannelName(data.ChannelId)
-	rmsg.Team = m.GetTeamName(rmsg.Raw.TeamId)
-	// direct message
-	if data.Type == "D" {
-		rmsg.Channel = m.GetUser(data.UserId).Username
+	// users are fetched when needed
+	if m.LazyLoad {
+		return nil
+	}
+	mmusers, err := m.client(ctx).GetUsers(url.Values{"in_team": {teamId}}, 0)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]*model.User)
+	for _, u := range mmusers {
+		users[u.Id] = u
 	}
-	rmsg.Text = data.Message
-	rmsg.Post = data
-	return
-}
-
-func (m *MMClient) UpdateUsers() error {
-	mmusers, _ := m.Client.GetProfilesForDirectMessageList(m.Team.Id)
 	m.Lock()
-	m.Users = mmusers.Data.(map[string]*model.User)
+	m.Users = users
+	m.reindexUsers()
 	m.Unlock()
 	return nil
 }
 
 func (m *MMClient) UpdateChannels() error {
-	mmchannels, _ := m.Client.GetChannels("")
-	mmchannels2, _ := m.Client.GetMoreChannels("")
-	m.Lock()
-	m.Team.Channels = mmchannels.Data.(*model.ChannelList)
-	m.Team.MoreChannels = mmchannels2.Data.(*model.ChannelList)
-	m.Unlock()
+	return m.UpdateChannelsContext(context.Background())
+}
+
+// UpdateChannelsContext refreshes the channels of all our (loaded) teams.
+func (m *MMClient) UpdateChannelsContext(ctx context.Context) error {
+	if _, err := m.teamId(); err != nil {
+		return err
+	}
+	m.RLock()
+	teams := m.OtherTeams
+	m.RUnlock()
+	client := m.client(ctx)
+	userId := m.userId()
+	for _, t := range teams {
+		if !t.loaded {
+			continue
+		}
+		channels, moreChannels, err := m.getChannels(client, userId, t.Id)
+		if err != nil {
+			return err
+		}
+		m.Lock()
+		// replace the team, callers may still be using the old one
+		if old := m.findTeam(t.Id); old != nil {
+			team := *old
+			team.Channels = channels
+			team.MoreChannels = moreChannels
+			m.replaceTeam(&team)
+		}
+		m.Unlock()
+	}
 	return nil
 }
 
+// getChannels returns the channels of teamId we're a member of, and the public channels we're not in.
+func (m *MMClient) getChannels(client *Client, userId string, teamId string) (*model.ChannelList, *model.ChannelList, error) {
+	mmchannels, err := client.GetChannelsForTeamForUser(teamId, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := client.GetChannelMembersForUser(userId, teamId)
+	if err != nil {
+		return nil, nil, err
+	}
+	channels := &model.ChannelList{Channels: mmchannels, Members: make(map[string]*model.ChannelMember)}
+	for _, member := range members {
+		channels.Members[member.ChannelId] = member
+	}
+	public, err := client.GetPublicChannelsForTeam(teamId)
+	if err != nil {
+		return nil, nil, err
+	}
+	moreChannels := &model.ChannelList{Members: make(map[string]*model.ChannelMember)}
+	for _, c := range public {
+		if _, ok := channels.Members[c.Id]; !ok {
+			moreChannels.Channels = append(moreChannels.Channels, c)
+		}
+	}
+	return channels, moreChannels, nil
+}
+
 func (m *MMClient) GetChannelName(channelId string) string {
 	m.RLock()
 	defer m.RUnlock()
-	for _, t := range m.OtherTeams {
-		for _, channel := range append(t.Channels.Channels, t.MoreChannels.Channels...) {
-			if channel.Id == channelId {
-				return channel.Name
-			}
-		}
+	if e, ok := m.channelsById[channelId]; ok {
+		return e.channel.Name
 	}
 	return ""
 }
 
+// GetChannelId returns the id of channel name in teamId (our team when empty).
+// name can be the (URL) name, display name or id of the channel, and can be
+// prefixed with a team name, e.g. "otherteam/town-square".
 func (m *MMClient) GetChannelId(name string, teamId string) string {
+	if i := strings.Index(name, "/"); teamId == "" && i > 0 {
+		if id := m.GetTeamId(name[:i]); id != "" {
+			teamId = id
+			name = name[i+1:]
+		}
+	}
 	m.RLock()
 	defer m.RUnlock()
-	if teamId == "" {
+	if teamId == "" && m.Team != nil {
 		teamId = m.Team.Id
 	}
+	if t := m.findTeam(teamId); t != nil && !t.loaded {
+		m.RUnlock()
+		m.loadTeam(context.Background(), teamId)
+		m.RLock()
+	}
+	if id, ok := m.channelIds[teamId+"/"+name]; ok {
+		return id
+	}
+	if id, ok := m.channelDisplayIds[teamId+"/"+strings.ToLower(name)]; ok {
+		return id
+	}
+	if e, ok := m.channelsById[name]; ok && (e.teamId == teamId || e.channel.TeamId == "") {
+		return name
+	}
+	return ""
+}
+
+// GetTeamId returns the id of the team with name (or display name) we're a member of.
+func (m *MMClient) GetTeamId(name string) string {
+	m.RLock()
+	defer m.RUnlock()
 	for _, t := range m.OtherTeams {
-		if t.Id == teamId {
-			for _, channel := range append(t.Channels.Channels, t.MoreChannels.Channels...) {
-				if channel.Name == name {
-					return channel.Id
-				}
-			}
+		if strings.EqualFold(t.Team.Name, name) || strings.EqualFold(t.Team.DisplayName, name) || t.Id == name {
+			return t.Id
 		}
 	}
 	return ""
@@ -306,151 +671,211 @@ func (m *MMClient) GetChannelId(name string, teamId string) string {
 func (m *MMClient) GetChannelHeader(channelId string) string {
 	m.RLock()
 	defer m.RUnlock()
-	for _, t := range m.OtherTeams {
-		for _, channel := range append(t.Channels.Channels, t.MoreChannels.Channels...) {
-			if channel.Id == channelId {
-				return channel.Header
-			}
-
-		}
+	if e, ok := m.channelsById[channelId]; ok {
+		return e.channel.Header
 	}
 	return ""
 }
 
 func (m *MMClient) PostMessage(channelId string, text string) {
+	if _, err := m.PostMessageContext(context.Background(), channelId, text); err != nil {
+		m.log.Errorf("PostMessage to %s failed: %s", channelId, err)
+	}
+}
+
+// PostMessageContext posts text to channelId and returns the created post.
+func (m *MMClient) PostMessageContext(ctx context.Context, channelId string, text string) (*model.Post, error) {
 	post := &model.Post{ChannelId: channelId, Message: text}
-	m.Client.CreatePost(post)
+	return m.client(ctx).CreatePost(post)
+}
+
+// PostMessageProps posts text to channelId with the given props. createAt is the
+// creation time in milliseconds, 0 lets the server decide.
+func (m *MMClient) PostMessageProps(channelId string, text string, props map[string]interface{}, createAt int64) {
+	if _, err := m.PostMessagePropsContext(context.Background(), channelId, text, props, createAt); err != nil {
+		m.log.Errorf("PostMessageProps to %s failed: %s", channelId, err)
+	}
+}
+
+// PostMessagePropsContext is PostMessageProps returning the created post.
+func (m *MMClient) PostMessagePropsContext(ctx context.Context, channelId string, text string, props map[string]interface{}, createAt int64) (*model.Post, error) {
+	post := &model.Post{ChannelId: channelId, Message: text, Props: props, CreateAt: createAt}
+	return m.client(ctx).CreatePost(post)
 }
 
 func (m *MMClient) JoinChannel(channelId string) error {
-	m.RLock()
-	defer m.RUnlock()
-	for _, c := range m.Team.Channels.Channels {
-		if c.Id == channelId {
-			m.log.Debug("Not joining ", channelId, " already joined.")
-			return nil
-		}
+	return m.JoinChannelContext(context.Background(), channelId)
+}
+
+// JoinChannelContext joins channelId, nothing happens if we're already a member.
+// Private channels can't be joined, someone has to add us.
+func (m *MMClient) JoinChannelContext(ctx context.Context, channelId string) error {
+	if _, err := m.teamId(); err != nil {
+		return err
+	}
+	if m.isMember(channelId) {
+		m.log.Debug("Not joining ", channelId, " already joined.")
+		return nil
 	}
 	m.log.Debug("Joining ", channelId)
-	_, err := m.Client.JoinChannel(channelId)
-	if err != nil {
-		return errors.New("failed to join")
+	if err := m.client(ctx).AddChannelMember(channelId, m.userId()); err != nil {
+		return err
 	}
-	return nil
+	return m.fetchChannel(ctx, channelId, true)
 }
 
-func (m *MMClient) GetPostsSince(channelId string, time int64) *model.PostList {
-	res, err := m.Client.GetPostsSince(channelId, time)
+// CreateChannelContext creates a channel in teamId (our team when empty) and returns it.
+// name is the URL name (lowercase letters, digits, - and _).
+func (m *MMClient) CreateChannelContext(ctx context.Context, teamId string, name string, displayName string, purpose string, private bool) (*model.Channel, error) {
+	if teamId == "" {
+		var err error
+		if teamId, err = m.teamId(); err != nil {
+			return nil, err
+		}
+	}
+	channel := &model.Channel{TeamId: teamId, Name: name, DisplayName: displayName, Purpose: purpose, Type: model.CHANNEL_OPEN}
+	if private {
+		channel.Type = model.CHANNEL_PRIVATE
+	}
+	m.log.Debugf("Creating channel %s in team %s", name, teamId)
+	channel, err := m.client(ctx).CreateChannel(channel)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return res.Data.(*model.PostList)
+	m.setChannel(channel.Id, channel, true)
+	return channel, nil
+}
+
+func (m *MMClient) GetPostsSince(channelId string, time int64) *model.PostList {
+	res, _ := m.GetPostsSinceContext(context.Background(), channelId, time)
+	return res
+}
+
+// GetPostsSinceContext returns the posts of channelId created or changed since time (in milliseconds).
+func (m *MMClient) GetPostsSinceContext(ctx context.Context, channelId string, time int64) (*model.PostList, error) {
+	return m.client(ctx).GetPostsSince(channelId, time)
 }
 
 func (m *MMClient) SearchPosts(query string) *model.PostList {
-	res, err := m.Client.SearchPosts(query, false)
+	res, _ := m.SearchPostsContext(context.Background(), query)
+	return res
+}
+
+// SearchPostsContext searches the posts of our team.
+func (m *MMClient) SearchPostsContext(ctx context.Context, query string) (*model.PostList, error) {
+	teamId, err := m.teamId()
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return res.Data.(*model.PostList)
+	return m.client(ctx).SearchPosts(teamId, query, false)
 }
 
 func (m *MMClient) GetPosts(channelId string, limit int) *model.PostList {
-	res, err := m.Client.GetPosts(channelId, 0, limit, "")
-	if err != nil {
-		return nil
-	}
-	return res.Data.(*model.PostList)
+	res, _ := m.GetPostsContext(context.Background(), channelId, limit)
+	return res
 }
 
-func (m *MMClient) GetPublicLink(filename string) string {
-	res, err := m.Client.GetPublicLink(filename)
-	if err != nil {
-		return ""
-	}
-	return res.Data.(string)
+// GetPostsContext returns the last limit posts of channelId.
+func (m *MMClient) GetPostsContext(ctx context.Context, channelId string, limit int) (*model.PostList, error) {
+	return m.client(ctx).GetPostsForChannel(channelId, 0, limit)
 }
 
-func (m *MMClient) GetPublicLinks(filenames []string) []string {
+// GetPublicLink returns the public link of a file (fileId in API v4).
+func (m *MMClient) GetPublicLink(fileId string) string {
+	res, _ := m.GetPublicLinkContext(context.Background(), fileId)
+	return res
+}
+
+// GetPublicLinkContext returns the public link of a file.
+func (m *MMClient) GetPublicLinkContext(ctx context.Context, fileId string) (string, error) {
+	return m.client(ctx).GetFileLink(fileId)
+}
+
+func (m *MMClient) GetPublicLinks(fileIds []string) []string {
 	var output []string
-	for _, f := range filenames {
-		res, err := m.Client.GetPublicLink(f)
+	for _, f := range fileIds {
+		res, err := m.client(context.Background()).GetFileLink(f)
 		if err != nil {
 			continue
 		}
-		output = append(output, res.Data.(string))
+		output = append(output, res)
 	}
 	return output
 }
 
 func (m *MMClient) UpdateChannelHeader(channelId string, header string) {
-	data := make(map[string]string)
-	data["channel_id"] = channelId
-	data["channel_header"] = header
-	m.log.Debugf("updating channelheader %#v, %#v", channelId, header)
-	_, err := m.Client.UpdateChannelHeader(data)
-	if err != nil {
-		log.Error(err)
+	if err := m.UpdateChannelHeaderContext(context.Background(), channelId, header); err != nil {
+		m.log.Error(err)
 	}
 }
 
+// UpdateChannelHeaderContext sets the header of channelId.
+func (m *MMClient) UpdateChannelHeaderContext(ctx context.Context, channelId string, header string) error {
+	m.log.Debugf("updating channelheader %#v, %#v", channelId, header)
+	_, err := m.client(ctx).PatchChannel(channelId, map[string]string{"header": header})
+	return err
+}
+
 func (m *MMClient) UpdateLastViewed(channelId string) {
-	m.log.Debugf("posting lastview %#v", channelId)
-	_, err := m.Client.UpdateLastViewedAt(channelId)
-	if err != nil {
+	if err := m.UpdateLastViewedContext(context.Background(), channelId); err != nil {
 		m.log.Error(err)
 	}
 }
 
+// UpdateLastViewedContext marks channelId as read.
+func (m *MMClient) UpdateLastViewedContext(ctx context.Context, channelId string) error {
+	m.log.Debugf("posting lastview %#v", channelId)
+	return m.client(ctx).ViewChannel(m.userId(), channelId)
+}
+
 func (m *MMClient) UsernamesInChannel(channelId string) []string {
-	ceiRes, err := m.Client.GetChannelExtraInfo(channelId, 5000, "")
+	result, err := m.UsernamesInChannelContext(context.Background(), channelId)
 	if err != nil {
 		m.log.Errorf("UsernamesInChannel(%s) failed: %s", channelId, err)
 		return []string{}
 	}
-	extra := ceiRes.Data.(*model.ChannelExtra)
-	result := []string{}
-	for _, member := range extra.Members {
-		result = append(result, member.Username)
-	}
 	return result
 }
 
-func (m *MMClient) createCookieJar(token string) *cookiejar.Jar {
-	var cookies []*http.Cookie
-	jar, _ := cookiejar.New(nil)
-	firstCookie := &http.Cookie{
-		Name:   "MMAUTHTOKEN",
-		Value:  token,
-		Path:   "/",
-		Domain: m.Credentials.Server,
+// UsernamesInChannelContext returns the usernames of the members of channelId.
+func (m *MMClient) UsernamesInChannelContext(ctx context.Context, channelId string) ([]string, error) {
+	members, err := m.client(ctx).GetUsers(url.Values{"in_channel": {channelId}}, 5000)
+	if err != nil {
+		return nil, err
 	}
-	cookies = append(cookies, firstCookie)
-	cookieURL, _ := url.Parse("https://" + m.Credentials.Server)
-	jar.SetCookies(cookieURL, cookies)
-	return jar
+	result := []string{}
+	for _, member := range members {
+		result = append(result, member.Username)
+	}
+	return result, nil
 }
 
 // SendDirectMessage sends a direct message to specified user
 func (m *MMClient) SendDirectMessage(toUserId string, msg string) {
+	if _, err := m.SendDirectMessageContext(context.Background(), toUserId, msg); err != nil {
+		m.log.Errorf("SendDirectMessage to %#v failed: %s", toUserId, err)
+	}
+}
+
+// SendDirectMessageContext sends a direct message to toUserId and returns the created post.
+func (m *MMClient) SendDirectMessageContext(ctx context.Context, toUserId string, msg string) (*model.Post, error) {
 	m.log.Debugf("SendDirectMessage to %s, msg %s", toUserId, msg)
-	// create DM channel (only happens on first message)
-	_, err := m.Client.CreateDirectChannel(toUserId)
+	client := m.client(ctx)
+	// create DM channel (returns the existing one if we already have one)
+	channel, err := client.CreateDirectChannel(m.userId(), toUserId)
 	if err != nil {
-		m.log.Debugf("SendDirectMessage to %#v failed: %s", toUserId, err)
+		return nil, err
 	}
-	channelName := model.GetDMNameFromIds(toUserId, m.User.Id)
 
 	// update our channels
-	mmchannels, _ := m.Client.GetChannels("")
-	m.Lock()
-	m.Team.Channels = mmchannels.Data.(*model.ChannelList)
-	m.Unlock()
+	if m.getChannel(channel.Id) == nil {
+		m.setChannel(channel.Id, channel, true)
+	}
 
 	// build & send the message
 	msg = strings.Replace(msg, "\r", "", -1)
-	post := &model.Post{ChannelId: m.GetChannelId(channelName, ""), Message: msg}
-	m.Client.CreatePost(post)
+	post := &model.Post{ChannelId: channel.Id, Message: msg}
+	return client.CreatePost(post)
 }
 
 // GetTeamName returns the name of the specified teamId
@@ -465,11 +890,24 @@ func (m *MMClient) GetTeamName(teamId string) string {
 	return ""
 }
 
+// getChannel returns the channel with channelId we're a member of, nil if not found.
+func (m *MMClient) getChannel(channelId string) *model.Channel {
+	m.RLock()
+	defer m.RUnlock()
+	if e, ok := m.channelsById[channelId]; ok && e.member {
+		return e.channel
+	}
+	return nil
+}
+
 // GetChannels returns all channels we're members off
 func (m *MMClient) GetChannels() []*model.Channel {
 	m.RLock()
 	defer m.RUnlock()
 	var channels []*model.Channel
+	if m.Team == nil {
+		return channels
+	}
 	// our primary team channels first
 	channels = append(channels, m.Team.Channels.Channels...)
 	for _, t := range m.OtherTeams {
@@ -495,14 +933,8 @@ func (m *MMClient) GetMoreChannels() []*model.Channel {
 func (m *MMClient) GetTeamFromChannel(channelId string) string {
 	m.RLock()
 	defer m.RUnlock()
-	var channels []*model.Channel
-	for _, t := range m.OtherTeams {
-		channels = append(channels, t.Channels.Channels...)
-		for _, c := range channels {
-			if c.Id == channelId {
-				return t.Id
-			}
-		}
+	if e, ok := m.channelsById[channelId]; ok && e.member {
+		return e.teamId
 	}
 	return ""
 }
@@ -531,40 +963,108 @@ func (m *MMClient) GetUsers() map[string]*model.User {
 func (m *MMClient) GetUser(userId string) *model.User {
 	m.RLock()
 	defer m.RUnlock()
-	return m.Users[userId]
+	user, ok := m.Users[userId]
+	if ok && m.userCache != nil {
+		m.userCache.touch(userId)
+	}
+	return user
+}
+
+// GetUserId returns the id of username, the user is fetched from the server if we don't know it.
+func (m *MMClient) GetUserId(username string) string {
+	id, err := m.GetUserIdContext(context.Background(), username)
+	if err != nil && !IsNotFound(err) {
+		m.log.Errorf("getting user %s failed: %s", username, err)
+	}
+	return id
+}
+
+// GetUserIdContext returns the id of username, the user is fetched from the server if we don't know it.
+func (m *MMClient) GetUserIdContext(ctx context.Context, username string) (string, error) {
+	m.RLock()
+	id, ok := m.usernames[strings.ToLower(username)]
+	m.RUnlock()
+	if ok {
+		return id, nil
+	}
+	user, err := m.client(ctx).GetUserByUsername(username)
+	if err != nil {
+		return "", err
+	}
+	m.setUser(user)
+	return user.Id, nil
 }
 
 // initialize user and teams
-func (m *MMClient) initUser() error {
-	m.Lock()
-	defer m.Unlock()
+func (m *MMClient) initUser(client *Client, user *model.User) error {
 	m.log.Debug("initUser()")
-	initLoad, err := m.Client.GetInitialLoad()
+	teams, err := client.GetTeamsForUser(user.Id)
 	if err != nil {
 		return err
 	}
-	initData := initLoad.Data.(*model.InitialLoad)
-	m.User = initData.User
 	// we only load all team data on initial login.
 	// all other updates are for channels from our (primary) team only.
 	m.log.Debug("initUser(): loading all team data")
-	for _, v := range initData.Teams {
-		m.Client.SetTeamId(v.Id)
-		mmusers, _ := m.Client.GetProfiles(v.Id, "")
-		t := &Team{Team: v, Users: mmusers.Data.(map[string]*model.User), Id: v.Id}
-		mmchannels, _ := m.Client.GetChannels("")
-		t.Channels = mmchannels.Data.(*model.ChannelList)
-		mmchannels, _ = m.Client.GetMoreChannels("")
-		t.MoreChannels = mmchannels.Data.(*model.ChannelList)
-		m.OtherTeams = append(m.OtherTeams, t)
+	var myTeam *Team
+	var otherTeams []*Team
+	users := make(map[string]*model.User)
+	for _, v := range teams {
+		t := &Team{Team: v, Users: make(map[string]*model.User), Id: v.Id}
+		if m.LazyLoad && v.Name != m.Credentials.Team {
+			t.Channels = &model.ChannelList{Members: make(map[string]*model.ChannelMember)}
+			t.MoreChannels = &model.ChannelList{Members: make(map[string]*model.ChannelMember)}
+			otherTeams = append(otherTeams, t)
+			continue
+		}
+		if !m.LazyLoad {
+			mmusers, err := client.GetUsers(url.Values{"in_team": {v.Id}}, 0)
+			if err != nil {
+				return err
+			}
+			for _, u := range mmusers {
+				t.Users[u.Id] = u
+			}
+		}
+		t.Channels, t.MoreChannels, err = m.getChannels(client, user.Id, v.Id)
+		if err != nil {
+			return err
+		}
+		t.loaded = true
+		otherTeams = append(otherTeams, t)
 		if v.Name == m.Credentials.Team {
-			m.Team = t
+			myTeam = t
 			m.log.Debugf("initUser(): found our team %s (id: %s)", v.Name, v.Id)
 		}
 		// add all users
 		for k, v := range t.Users {
-			m.Users[k] = v
+			users[k] = v
+		}
+	}
+	if myTeam == nil {
+		return errors.New("team " + m.Credentials.Team + " not found")
+	}
+	m.Lock()
+	if m.LazyLoad {
+		if m.userCache == nil {
+			m.userCache = newLRU(m.UserCacheSize)
 		}
+		m.userCache.reset()
 	}
+	client.onSessionExpired = m.sessionExpired
+	m.Client = client
+	m.clientConfig = nil
+	m.User = user
+	m.Team = myTeam
+	m.OtherTeams = otherTeams
+	m.Users = users
+	m.reindex()
+	m.Unlock()
 	return nil
 }
+
+// GetMe returns the user we're logged in as.
+func (m *MMClient) GetMe() *model.User {
+	m.RLock()
+	defer m.RUnlock()
+	return m.User
+}
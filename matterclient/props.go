@@ -0,0 +1,85 @@
+package matterclient
+
+import (
+	"context"
+)
+
+// Attachment is a message attachment, added to a post with the "attachments" prop.
+type Attachment struct {
+	Fallback   string             `json:"fallback,omitempty"`
+	Color      string             `json:"color,omitempty"`
+	Pretext    string             `json:"pretext,omitempty"`
+	AuthorName string             `json:"author_name,omitempty"`
+	AuthorLink string             `json:"author_link,omitempty"`
+	AuthorIcon string             `json:"author_icon,omitempty"`
+	Title      string             `json:"title,omitempty"`
+	TitleLink  string             `json:"title_link,omitempty"`
+	Text       string             `json:"text,omitempty"`
+	ImageURL   string             `json:"image_url,omitempty"`
+	ThumbURL   string             `json:"thumb_url,omitempty"`
+	Fields     []*AttachmentField `json:"fields,omitempty"`
+}
+
+type AttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// OverrideProps returns the post props showing the post as coming from
+// username with iconURL (if not empty) instead of from us. The server only
+// honours them when EnablePostUsernameOverride/EnablePostIconOverride are set,
+// see CanOverrideUsername and CanOverrideIcon.
+func OverrideProps(username string, iconURL string) map[string]interface{} {
+	props := map[string]interface{}{
+		"from_webhook":      "true",
+		"override_username": username,
+	}
+	if iconURL != "" {
+		props["override_icon_url"] = iconURL
+	}
+	return props
+}
+
+// AttachmentProps returns the post props adding attachments to a post.
+func AttachmentProps(attachments []*Attachment) map[string]interface{} {
+	return map[string]interface{}{"attachments": attachments}
+}
+
+// GetClientConfig returns the client configuration of the server, it's fetched once per login.
+func (m *MMClient) GetClientConfig(ctx context.Context) (map[string]string, error) {
+	m.RLock()
+	config := m.clientConfig
+	m.RUnlock()
+	if config != nil {
+		return config, nil
+	}
+	config, err := m.client(ctx).GetClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	m.Lock()
+	m.clientConfig = config
+	m.Unlock()
+	return config, nil
+}
+
+// CanOverrideUsername returns true if the server allows posts with override_username.
+func (m *MMClient) CanOverrideUsername(ctx context.Context) bool {
+	config, err := m.GetClientConfig(ctx)
+	if err != nil {
+		m.log.Errorf("getting client config failed: %s", err)
+		return false
+	}
+	return config["EnablePostUsernameOverride"] == "true"
+}
+
+// CanOverrideIcon returns true if the server allows posts with override_icon_url.
+func (m *MMClient) CanOverrideIcon(ctx context.Context) bool {
+	config, err := m.GetClientConfig(ctx)
+	if err != nil {
+		m.log.Errorf("getting client config failed: %s", err)
+		return false
+	}
+	return config["EnablePostIconOverride"] == "true"
+}
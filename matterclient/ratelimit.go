@@ -0,0 +1,132 @@
+package matterclient
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	// retries of idempotent requests and posts after rate limiting or transient errors
+	maxRetries = 5
+	// wait this long after a 429 without reset information
+	defaultRateLimitWait = time.Second
+)
+
+// ClientStats counts requests and throttling of a Client.
+type ClientStats struct {
+	Requests    int64
+	Retries     int64
+	RateLimited int64 // 429 responses
+	Throttled   int64 // requests delayed by the rate limiter
+	// total time requests were delayed by the rate limiter
+	ThrottledTime time.Duration
+}
+
+// rateLimiter delays requests until the rate limit of the server resets.
+type rateLimiter struct {
+	sync.Mutex
+	until time.Time
+	stats ClientStats
+}
+
+// wait blocks until we're allowed to make a request or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.Lock()
+	d := time.Until(l.until)
+	if d > 0 {
+		l.stats.Throttled++
+		l.stats.ThrottledTime += d
+	}
+	l.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	return sleep(ctx, d)
+}
+
+// update records the rate limit headers of rp.
+func (l *rateLimiter) update(rp *http.Response) {
+	var d time.Duration
+	switch {
+	case rp.StatusCode == http.StatusTooManyRequests:
+		d = defaultRateLimitWait
+		if after, ok := retryAfter(rp.Header); ok {
+			d = after
+		}
+	case rp.Header.Get("X-Ratelimit-Remaining") == "0":
+		reset, err := strconv.Atoi(rp.Header.Get("X-Ratelimit-Reset"))
+		if err != nil {
+			return
+		}
+		d = time.Duration(reset) * time.Second
+	default:
+		return
+	}
+	l.Lock()
+	if rp.StatusCode == http.StatusTooManyRequests {
+		l.stats.RateLimited++
+	}
+	if until := time.Now().Add(d); until.After(l.until) {
+		l.until = until
+	}
+	l.Unlock()
+}
+
+// retryAfter returns how long the server wants us to wait from the
+// Retry-After or X-Ratelimit-Reset header (seconds until the limit resets).
+func retryAfter(h http.Header) (time.Duration, bool) {
+	if secs, err := strconv.Atoi(h.Get("Retry-After")); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if secs, err := strconv.Atoi(h.Get("X-Ratelimit-Reset")); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	return 0, false
+}
+
+// Stats returns the request statistics of the client (shared by its WithContext copies).
+func (c *Client) Stats() ClientStats {
+	c.limiter.Lock()
+	defer c.limiter.Unlock()
+	return c.limiter.stats
+}
+
+// count increments a counter of the stats.
+func (l *rateLimiter) count(counter *int64) {
+	l.Lock()
+	*counter++
+	l.Unlock()
+}
+
+// Stats returns the request statistics of the API client.
+func (m *MMClient) Stats() ClientStats {
+	return m.client(context.Background()).Stats()
+}
+
+// retryable returns true if a failed request can be sent again without side effects.
+// Posts are deduplicated by the server with their PendingPostId.
+func retryable(method string, path string) bool {
+	return method == "GET" || method == "PUT" || method == "DELETE" || (method == "POST" && path == "/posts")
+}
+
+// pendingPostId returns an id for deduplicating retried posts.
+func pendingPostId() string {
+	return model.NewId() + ":" + strconv.FormatInt(model.GetMillis(), 10)
+}
+
+// sleep waits d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
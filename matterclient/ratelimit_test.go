@@ -0,0 +1,97 @@
+package matterclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func response(status int, headers map[string]string) *http.Response {
+	rp := &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    &http.Request{Method: "POST", URL: &url.URL{Path: "/api/v4/posts"}},
+	}
+	for k, v := range headers {
+		rp.Header.Set(k, v)
+	}
+	return rp
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    time.Duration
+		ok      bool
+	}{
+		{map[string]string{"Retry-After": "7"}, 7 * time.Second, true},
+		{map[string]string{"X-Ratelimit-Reset": "3"}, 3 * time.Second, true},
+		// Retry-After wins
+		{map[string]string{"Retry-After": "7", "X-Ratelimit-Reset": "3"}, 7 * time.Second, true},
+		// HTTP dates aren't used by mattermost
+		{map[string]string{"Retry-After": "Wed, 21 Oct 2015 07:28:00 GMT"}, 0, false},
+		{map[string]string{"Retry-After": "Wed, 21 Oct 2015 07:28:00 GMT", "X-Ratelimit-Reset": "3"}, 3 * time.Second, true},
+		{nil, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(response(http.StatusTooManyRequests, tt.headers).Header)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%v) = %s, %v, want %s, %v", tt.headers, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRateLimiterUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		headers     map[string]string
+		wait        time.Duration // 0 if requests aren't delayed
+		rateLimited int64
+	}{
+		{"ok", http.StatusOK, map[string]string{"X-Ratelimit-Remaining": "9", "X-Ratelimit-Reset": "1"}, 0, 0},
+		{"last request", http.StatusOK, map[string]string{"X-Ratelimit-Remaining": "0", "X-Ratelimit-Reset": "2"}, 2 * time.Second, 0},
+		{"last request without reset", http.StatusOK, map[string]string{"X-Ratelimit-Remaining": "0"}, 0, 0},
+		{"rate limited", http.StatusTooManyRequests, map[string]string{"Retry-After": "5"}, 5 * time.Second, 1},
+		{"rate limited with reset", http.StatusTooManyRequests, map[string]string{"X-Ratelimit-Reset": "4"}, 4 * time.Second, 1},
+		{"rate limited without headers", http.StatusTooManyRequests, nil, defaultRateLimitWait, 1},
+		{"server error", http.StatusInternalServerError, nil, 0, 0},
+	}
+	for _, tt := range tests {
+		l := &rateLimiter{}
+		start := time.Now()
+		l.update(response(tt.status, tt.headers))
+		if tt.wait == 0 {
+			if !l.until.IsZero() {
+				t.Errorf("%s: requests delayed until %s", tt.name, l.until)
+			}
+		} else if wait := l.until.Sub(start); wait < tt.wait || wait > tt.wait+time.Second {
+			t.Errorf("%s: requests delayed %s, want %s", tt.name, wait, tt.wait)
+		}
+		if l.stats.RateLimited != tt.rateLimited {
+			t.Errorf("%s: RateLimited = %d, want %d", tt.name, l.stats.RateLimited, tt.rateLimited)
+		}
+	}
+}
+
+func TestRateLimiterKeepsLongestWait(t *testing.T) {
+	l := &rateLimiter{}
+	l.update(response(http.StatusTooManyRequests, map[string]string{"Retry-After": "10"}))
+	until := l.until
+	l.update(response(http.StatusOK, map[string]string{"X-Ratelimit-Remaining": "0", "X-Ratelimit-Reset": "1"}))
+	if !l.until.Equal(until) {
+		t.Errorf("shorter reset moved the wait from %s to %s", until, l.until)
+	}
+}
+
+func TestHTTPErrorRetryAfter(t *testing.T) {
+	e := httpError(response(http.StatusTooManyRequests, map[string]string{"Retry-After": "7"}))
+	if !IsRateLimited(e) || e.RetryAfter != 7*time.Second {
+		t.Errorf("httpError = %v with RetryAfter %s, want rate limited with 7s", e, e.RetryAfter)
+	}
+}